@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// cloudwatchBatchSize is the maximum number of metrics accepted by a single
+// PutMetricData call.
+const cloudwatchBatchSize = 20
+
+var (
+	cloudwatchNamespace = kingpin.Flag(
+		"cloudwatch.namespace", "CloudWatch namespace to push quota metrics to. Disabled when empty.",
+	).Envar("CLOUDWATCH_NAMESPACE").String()
+
+	cloudwatchRegion = kingpin.Flag(
+		"cloudwatch.region", "AWS region of CloudWatch, overriding the region from the AWS SDK configuration.",
+	).String()
+
+	cloudwatchInterval = kingpin.Flag(
+		"cloudwatch.interval", "How often quota metrics are pushed to CloudWatch.",
+	).Default("1m").Duration()
+)
+
+// cloudwatchClient is the part of the CloudWatch API used by cloudwatchSink.
+type cloudwatchClient interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// cloudwatchSink periodically gathers the quota metrics and pushes them to
+// CloudWatch as custom metrics.
+type cloudwatchSink struct {
+	gatherer  prometheus.Gatherer
+	namespace string
+	client    cloudwatchClient
+}
+
+// newCloudwatchSink returns a sink authenticating with the standard AWS SDK
+// credential chain.
+func newCloudwatchSink(gatherer prometheus.Gatherer) (*cloudwatchSink, error) {
+	var options []func(*awsconfig.LoadOptions) error
+	if *cloudwatchRegion != "" {
+		options = append(options, awsconfig.WithRegion(*cloudwatchRegion))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS configuration: %v", err)
+	}
+
+	return &cloudwatchSink{
+		gatherer:  gatherer,
+		namespace: *cloudwatchNamespace,
+		client:    cloudwatch.NewFromConfig(cfg),
+	}, nil
+}
+
+// push gathers the quota metrics and sends them in batches of
+// cloudwatchBatchSize.
+func (s *cloudwatchSink) push(now time.Time) error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	data := cloudwatchData(families, now)
+	for start := 0; start < len(data); start += cloudwatchBatchSize {
+		end := start + cloudwatchBatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		_, err := s.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(s.namespace),
+			MetricData: data[start:end],
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudwatchData converts the gauge samples of the families selected by
+// pushedMetric to CloudWatch metric data, mapping labels to dimensions.
+func cloudwatchData(families []*dto.MetricFamily, now time.Time) []types.MetricDatum {
+	var data []types.MetricDatum
+	for _, family := range families {
+		if !pushedMetric(family.GetName()) {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			// Stale markers are NaN, which PutMetricData rejects along
+			// with the whole batch.
+			if metric.GetGauge() == nil || math.IsNaN(metric.GetGauge().GetValue()) {
+				continue
+			}
+
+			var dimensions []types.Dimension
+			for _, label := range metric.GetLabel() {
+				// CloudWatch rejects empty dimension values, e.g. the region of project quotas.
+				if label.GetValue() == "" {
+					continue
+				}
+				dimensions = append(dimensions, types.Dimension{
+					Name:  aws.String(label.GetName()),
+					Value: aws.String(label.GetValue()),
+				})
+			}
+
+			data = append(data, types.MetricDatum{
+				MetricName: aws.String(family.GetName()),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(now),
+				Unit:       types.StandardUnitCount,
+				Value:      aws.Float64(metric.GetGauge().GetValue()),
+			})
+		}
+	}
+	return data
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeCloudwatch records the PutMetricData calls.
+type fakeCloudwatch struct {
+	calls []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCloudwatch) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.calls = append(f.calls, params)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudwatchPush(t *testing.T) {
+	limit := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gcp_quota_limit"}, []string{"project", "region", "metric"})
+	limit.WithLabelValues("my-project", "", "CPUS_ALL_REGIONS").Set(24)
+	for i := 0; i < 24; i++ {
+		limit.WithLabelValues("my-project", "us-east1", fmt.Sprintf("METRIC_%02d", i)).Set(float64(i))
+	}
+	limit.WithLabelValues("my-project", "us-east1", "SNAPSHOTS").Set(math.NaN()) // a stale marker
+	ignored := prometheus.NewGauge(prometheus.GaugeOpts{Name: "gcp_quota_project_up"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(limit, ignored)
+
+	client := &fakeCloudwatch{}
+	sink := &cloudwatchSink{gatherer: registry, namespace: "GCP/Quotas", client: client}
+	now := time.Unix(1, 0)
+	if err := sink.push(now); err != nil {
+		t.Fatalf("TestCloudwatchPush: %v", err)
+	}
+
+	// 25 samples are sent in batches of 20.
+	if len(client.calls) != 2 || len(client.calls[0].MetricData) != 20 || len(client.calls[1].MetricData) != 5 {
+		t.Fatalf("TestCloudwatchPush: got %d calls, expected batches of 20 and 5", len(client.calls))
+	}
+
+	dimensions := map[string]map[string]string{}
+	for _, call := range client.calls {
+		if aws.ToString(call.Namespace) != "GCP/Quotas" {
+			t.Errorf("TestCloudwatchPush: namespace=%q, expected=GCP/Quotas", aws.ToString(call.Namespace))
+		}
+		for _, datum := range call.MetricData {
+			if aws.ToString(datum.MetricName) != "gcp_quota_limit" || !aws.ToTime(datum.Timestamp).Equal(now) {
+				t.Errorf("TestCloudwatchPush: datum=%s at %v, expected gcp_quota_limit at %v", aws.ToString(datum.MetricName), aws.ToTime(datum.Timestamp), now)
+			}
+			labels := map[string]string{}
+			for _, dimension := range datum.Dimensions {
+				labels[aws.ToString(dimension.Name)] = aws.ToString(dimension.Value)
+			}
+			dimensions[labels["metric"]] = labels
+		}
+	}
+
+	// Labels become dimensions, except empty ones.
+	if got := dimensions["CPUS_ALL_REGIONS"]; len(got) != 2 || got["project"] != "my-project" {
+		t.Errorf("TestCloudwatchPush: CPUS_ALL_REGIONS dimensions=%v, expected project and metric only", got)
+	}
+	if got := dimensions["METRIC_07"]; len(got) != 3 || got["project"] != "my-project" || got["region"] != "us-east1" {
+		t.Errorf("TestCloudwatchPush: METRIC_07 dimensions=%v, expected project, region and metric", got)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile = kingpin.Flag(
+		"config.file", "YAML or JSON file listing the projects to monitor and their filters. Takes precedence over --gcp.project_id. ($GCP_EXPORTER_CONFIG_FILE)",
+	).Envar("GCP_EXPORTER_CONFIG_FILE").String()
+
+	gcpConcurrency = kingpin.Flag(
+		"gcp.concurrency", "Maximum number of projects of the config file scraped at the same time. ($GCP_EXPORTER_CONCURRENCY)",
+	).Envar("GCP_EXPORTER_CONCURRENCY").Default("4").Int()
+)
+
+// config is the content of --config.file.
+type config struct {
+	Projects []projectConfig `yaml:"projects"`
+
+	// QuotaGroups are added to the groups of --gcp.quota-group, replacing
+	// those with the same name.
+	QuotaGroups map[string][]string `yaml:"quota_groups"`
+}
+
+// projectConfig describes a monitored project and the quotas exported for it.
+type projectConfig struct {
+	ID              string       `yaml:"id"`
+	CredentialsFile string       `yaml:"credentials_file"`
+	Regions         filterConfig `yaml:"regions"`
+	Metrics         filterConfig `yaml:"metrics"`
+
+	// regionFilter and metricFilter are compiled by loadConfig.
+	regionFilter *nameFilter
+	metricFilter *nameFilter
+}
+
+// filterConfig holds regular expressions matched against whole names, with
+// the precedence of nameFilter.
+type filterConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// loadConfig reads and validates the config file at path. JSON documents are
+// accepted as they are valid YAML.
+func loadConfig(path string) (*config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+
+	var cfg config
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %v", path, err)
+	}
+	if len(cfg.Projects) == 0 {
+		return nil, fmt.Errorf("Error in config file %s: no projects", path)
+	}
+
+	ids := make(map[string]bool)
+	for i := range cfg.Projects {
+		project := &cfg.Projects[i]
+		if project.ID == "" {
+			return nil, fmt.Errorf("Error in config file %s: project %d has no id", path, i)
+		}
+		if ids[project.ID] {
+			return nil, fmt.Errorf("Error in config file %s: project %s is listed twice", path, project.ID)
+		}
+		ids[project.ID] = true
+
+		if project.regionFilter, err = project.Regions.compile(); err != nil {
+			return nil, fmt.Errorf("Error in config file %s: project %s regions: %v", path, project.ID, err)
+		}
+		if project.metricFilter, err = project.Metrics.compile(); err != nil {
+			return nil, fmt.Errorf("Error in config file %s: project %s metrics: %v", path, project.ID, err)
+		}
+	}
+	for name, members := range cfg.QuotaGroups {
+		if len(members) == 0 {
+			return nil, fmt.Errorf("Error in config file %s: quota group %s has no members", path, name)
+		}
+	}
+	return &cfg, nil
+}
+
+// loadExporters returns the Exporters of the projects of --config.file.
+func loadExporters(logger log.Logger, basePath string) (exporters, error) {
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := assignCredentialsFiles(cfg.Projects, *gcpCredentialsFiles, true); err != nil {
+		return nil, err
+	}
+	es, err := newExporters(cfg.Projects, logger, basePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range es {
+		e.quotaGroups = mergeQuotaGroups(e.quotaGroups, cfg.QuotaGroups)
+	}
+	return es, nil
+}
+
+// mergeQuotaGroups returns the groups of both flags and config, those of
+// config replacing the flag groups with the same name.
+func mergeQuotaGroups(flags, config map[string][]string) map[string][]string {
+	merged := make(map[string][]string, len(flags)+len(config))
+	for name, members := range flags {
+		merged[name] = members
+	}
+	for name, members := range config {
+		merged[name] = members
+	}
+	return merged
+}
+
+// flagProjects returns the projects given with --gcp.project_id.
+func flagProjects(ids []string) ([]projectConfig, error) {
+	var projects []projectConfig
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("Error in --gcp.project_id: empty project ID")
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("Error in --gcp.project_id: project %s is given twice", id)
+		}
+		seen[id] = true
+		projects = append(projects, projectConfig{ID: id})
+	}
+	return projects, nil
+}
+
+// assignCredentialsFiles sets the credentials file of projects from the
+// --gcp.credentials-file flags. A single file is used by every project without
+// one of its own, several files are paired in order with the --gcp.project_id
+// flags. The projects of a config file set theirs with credentials_file.
+func assignCredentialsFiles(projects []projectConfig, files []string, fromConfig bool) error {
+	switch {
+	case len(files) == 1:
+		for i := range projects {
+			if projects[i].CredentialsFile == "" {
+				projects[i].CredentialsFile = files[0]
+			}
+		}
+	case len(files) > 1 && fromConfig:
+		return fmt.Errorf("Error in --gcp.credentials-file: can't be repeated with --config.file, set the credentials_file of the projects instead")
+	case len(files) > 1 && len(files) != len(projects):
+		return fmt.Errorf("Error in --gcp.credentials-file: %d files given for %d projects, give one per --gcp.project_id", len(files), len(projects))
+	case len(files) > 1:
+		for i := range projects {
+			projects[i].CredentialsFile = files[i]
+		}
+	}
+	return nil
+}
+
+// sharedCredentialsFile returns the credentials file of projects without one
+// of their own: the --gcp.credentials-file when it is given once, empty for
+// the Application Default Credentials otherwise.
+func sharedCredentialsFile(files []string) string {
+	if len(files) == 1 {
+		return files[0]
+	}
+	return ""
+}
+
+// compile returns the filter matching the configured names, or nil when it
+// has no patterns at all. The patterns are those of the --gcp.metric-* and
+// --gcp.region-* flags.
+func (c filterConfig) compile() (*nameFilter, error) {
+	if len(c.Include) == 0 && len(c.Exclude) == 0 {
+		return nil, nil
+	}
+
+	return newNameFilter(c.Include, c.Exclude)
+}
+
+// exporters collects several projects as a single collector, as the
+// Exporters of different projects share their descriptors. Each Exporter
+// guards its own state, so projects can be collected concurrently.
+type exporters []*Exporter
+
+// Describe implements prometheus.Collector.
+func (es exporters) Describe(ch chan<- *prometheus.Desc) {
+	for _, e := range es {
+		e.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector, collecting up to --gcp.concurrency
+// projects at once. The order of the metrics sent to ch doesn't matter.
+func (es exporters) Collect(ch chan<- prometheus.Metric) {
+	es.collect(context.Background(), ch)
+}
+
+// collect is Collect with the Google API calls bounded by ctx.
+func (es exporters) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	limit := *gcpConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+
+	var group errgroup.Group
+	group.SetLimit(limit)
+	for _, e := range es {
+		e := e
+		group.Go(func() error {
+			e.collect(ctx, ch)
+			return nil
+		})
+	}
+	group.Wait()
+}
+
+// Health returns the errors of the last scrape of the projects that failed,
+// prefixed with the project ID, empty when all of them succeeded.
+func (es exporters) Health() string {
+	var failures []string
+	for _, e := range es {
+		if err := e.Health(); err != "" {
+			failures = append(failures, e.project+": "+err)
+		}
+	}
+	return strings.Join(failures, "; ")
+}
+
+func (es exporters) Pause() {
+	for _, e := range es {
+		e.Pause()
+	}
+}
+
+func (es exporters) Resume() {
+	for _, e := range es {
+		e.Resume()
+	}
+}
+
+// ScrapeInProgressSeconds returns the longest running scrape in progress.
+func (es exporters) ScrapeInProgressSeconds() float64 {
+	var longest float64
+	for _, e := range es {
+		if seconds := e.ScrapeInProgressSeconds(); seconds > longest {
+			longest = seconds
+		}
+	}
+	return longest
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promlog "github.com/prometheus/common/promlog"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, content := range []string{
+		`
+projects:
+  - id: prod
+    regions:
+      include: ["europe-*"]
+    metrics:
+      exclude: [/^SNAP/]
+  - id: staging
+    credentials_file: /etc/gcp/staging.json
+`,
+		`{"projects": [{"id": "prod", "regions": {"include": ["europe-*"]}, "metrics": {"exclude": ["SNAPSHOTS"]}}, {"id": "staging", "credentials_file": "/etc/gcp/staging.json"}]}`,
+	} {
+		cfg, err := loadConfig(writeConfig(t, content))
+		if err != nil {
+			t.Fatalf("TestLoadConfig: %v", err)
+		}
+		if len(cfg.Projects) != 2 || cfg.Projects[0].ID != "prod" || cfg.Projects[1].ID != "staging" {
+			t.Fatalf("TestLoadConfig: projects=%+v, expected prod and staging", cfg.Projects)
+		}
+
+		prod, staging := cfg.Projects[0], cfg.Projects[1]
+		if !prod.regionFilter.matches("europe-west1") || prod.regionFilter.matches("us-east1") {
+			t.Errorf("TestLoadConfig: region filter doesn't keep europe-* only")
+		}
+		if prod.metricFilter.matches("SNAPSHOTS") || !prod.metricFilter.matches("CPUS") {
+			t.Errorf("TestLoadConfig: metric filter doesn't drop SNAPSHOTS only")
+		}
+		if staging.regionFilter != nil || staging.metricFilter != nil {
+			t.Errorf("TestLoadConfig: staging has filters, expected none")
+		}
+		if prod.CredentialsFile != "" || staging.CredentialsFile != "/etc/gcp/staging.json" {
+			t.Errorf("TestLoadConfig: credentials files=%q,%q, expected only staging to have one", prod.CredentialsFile, staging.CredentialsFile)
+		}
+	}
+}
+
+func TestAssignCredentialsFiles(t *testing.T) {
+	projects, err := flagProjects([]string{"prod", "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assignCredentialsFiles(projects, []string{"prod.json", "staging.json"}, false); err != nil {
+		t.Fatalf("TestAssignCredentialsFiles: %v", err)
+	}
+	if projects[0].CredentialsFile != "prod.json" || projects[1].CredentialsFile != "staging.json" {
+		t.Errorf("TestAssignCredentialsFiles: projects=%+v, expected the files in order", projects)
+	}
+
+	// A single file is shared, unless a project has its own.
+	projects = []projectConfig{{ID: "prod"}, {ID: "staging", CredentialsFile: "staging.json"}}
+	if err := assignCredentialsFiles(projects, []string{"shared.json"}, true); err != nil {
+		t.Fatalf("TestAssignCredentialsFiles: %v", err)
+	}
+	if projects[0].CredentialsFile != "shared.json" || projects[1].CredentialsFile != "staging.json" {
+		t.Errorf("TestAssignCredentialsFiles: projects=%+v, expected the shared file for prod only", projects)
+	}
+
+	for _, test := range []struct {
+		files      []string
+		fromConfig bool
+		err        string
+	}{
+		{[]string{"a.json", "b.json", "c.json"}, false, "3 files given for 2 projects"},
+		{[]string{"a.json", "b.json"}, true, "can't be repeated with --config.file"},
+	} {
+		err := assignCredentialsFiles([]projectConfig{{ID: "prod"}, {ID: "staging"}}, test.files, test.fromConfig)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("TestAssignCredentialsFiles: files=%q error=%v, expected %q", test.files, err, test.err)
+		}
+	}
+
+	for _, ids := range [][]string{{""}, {"prod", "prod"}} {
+		if _, err := flagProjects(ids); err == nil {
+			t.Errorf("TestAssignCredentialsFiles: project IDs %q accepted, expected an error", ids)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`projects: []`, "no projects"},
+		{`projects: [{regions: {include: [a]}}]`, "project 0 has no id"},
+		{`projects: [{id: prod}, {id: prod}]`, "project prod is listed twice"},
+		{`projects: [{id: prod, metrics: {include: ["/(/"]}}]`, "project prod metrics: Invalid filter pattern"},
+		{`projects: [{id: prod, zones: {}}]`, "field zones not found"},
+		{`{quota_groups: {cpus: []}, projects: [{id: prod}]}`, "quota group cpus has no members"},
+	}
+
+	for _, test := range tests {
+		_, err := loadConfig(writeConfig(t, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("TestLoadConfigErrors: %s: error=%v, expected=%q", test.content, err, test.err)
+		}
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	filter, err := filterConfig{Include: []string{"CPUS*"}, Exclude: []string{"CPUS_ALL_REGIONS"}}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{
+		"CPUS":               true,
+		"CPUS_PER_VM_FAMILY": true,
+		"CPUS_ALL_REGIONS":   false,
+		"N2_CPUS":            false,
+	} {
+		if got := filter.matches(name); got != expected {
+			t.Errorf("TestFilterConfig: matches(%s)=%v, expected=%v", name, got, expected)
+		}
+	}
+}
+
+func TestExportersFilters(t *testing.T) {
+	prod := newProjectReplayExporter(t, "testdata/fixtures", "prod")
+	prod.regionFilter, _ = filterConfig{Include: []string{"europe-west1"}}.compile()
+	prod.metricFilter, _ = filterConfig{Exclude: []string{"CPUS"}}.compile()
+
+	staging, err := newExporter(prod.service, "staging", prod.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both projects are served by the same replay server, the project is
+	// only used as a label.
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporters{prod, staging})
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("TestExportersFilters: gather failed: %v", err)
+	}
+
+	// prod: 4 project quotas and 2 in europe-west1 without CPUS, staging: 4
+	// project quotas and 3 in each of the 2 regions.
+	if got := testutil.CollectAndCount(exporters{prod, staging}, "gcp_quota_limit"); got != 16 {
+		t.Errorf("TestExportersFilters: gcp_quota_limit series=%d, expected=16", got)
+	}
+}
+
+func TestExportersConcurrency(t *testing.T) {
+	defer func(concurrency int) { *gcpConcurrency = concurrency }(*gcpConcurrency)
+	*gcpConcurrency = 3
+
+	var es exporters
+	for _, project := range []string{"alpha", "beta", "gamma", "delta", "epsilon"} {
+		es = append(es, newProjectReplayExporter(t, "testdata/fixtures", project))
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(es)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("TestExportersConcurrency: gather failed: %v", err)
+	}
+
+	projects := make(map[string]int)
+	for _, family := range families {
+		if family.GetName() != "gcp_quota_limit" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "project" {
+					projects[label.GetValue()]++
+				}
+			}
+		}
+	}
+	for _, e := range es {
+		if projects[e.project] != 10 {
+			t.Errorf("TestExportersConcurrency: %s has %d gcp_quota_limit series, expected=10", e.project, projects[e.project])
+		}
+	}
+}
+
+func TestExportersInaccessibleProject(t *testing.T) {
+	replay := newReplayServer(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/projects/denied") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"code": 403, "message": "Required 'compute.projects.get' permission"}}`))
+			return
+		}
+		replay.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var es exporters
+	for _, project := range []string{"allowed", "denied"} {
+		e, err := newExporter(service, project, promlog.New(&promlog.Config{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}
+
+	expected := `
+# HELP gcp_quota_project_up Was the last scrape of the Google Project API successful.
+# TYPE gcp_quota_project_up gauge
+gcp_quota_project_up{project="allowed"} 1
+gcp_quota_project_up{project="denied"} 0
+# HELP gcp_quota_regions_up Was the last scrape of the Google Regions API successful.
+# TYPE gcp_quota_regions_up gauge
+gcp_quota_regions_up{project="allowed"} 1
+gcp_quota_regions_up{project="denied"} 0
+`
+	if err := testutil.CollectAndCompare(es, strings.NewReader(expected), "gcp_quota_project_up", "gcp_quota_regions_up"); err != nil {
+		t.Errorf("TestExportersInaccessibleProject: %v", err)
+	}
+
+	for _, phase := range []string{"project", "region"} {
+		// Registering the collector scrapes it too, so count failures
+		// rather than scrapes.
+		if got := testutil.ToFloat64(es[1].scrapeErrors.WithLabelValues(phase, "permission_denied")); got == 0 {
+			t.Errorf("TestExportersInaccessibleProject: denied %s permission_denied errors=%v, expected>0", phase, got)
+		}
+		if got := testutil.ToFloat64(es[0].scrapeErrors.WithLabelValues(phase, "permission_denied")); got != 0 {
+			t.Errorf("TestExportersInaccessibleProject: allowed %s permission_denied errors=%v, expected=0", phase, got)
+		}
+	}
+	if got := testutil.CollectAndCount(es, "gcp_quota_limit"); got != 10 {
+		t.Errorf("TestExportersInaccessibleProject: gcp_quota_limit series=%d, expected the 10 of the allowed project", got)
+	}
+}
+
+func TestConfigQuotaGroups(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+quota_groups:
+  compute-capacity: [CPUS, N2_CPUS]
+projects:
+  - id: prod
+`))
+	if err != nil {
+		t.Fatalf("TestConfigQuotaGroups: %v", err)
+	}
+
+	// The config file replaces the flag group of the same name.
+	flags := map[string][]string{"compute-capacity": {"CPUS"}, "storage": {"SNAPSHOTS"}}
+	merged := mergeQuotaGroups(flags, cfg.QuotaGroups)
+	if len(merged) != 2 || strings.Join(merged["compute-capacity"], ",") != "CPUS,N2_CPUS" || strings.Join(merged["storage"], ",") != "SNAPSHOTS" {
+		t.Errorf("TestConfigQuotaGroups: groups=%v, expected compute-capacity from the config file and storage from the flags", merged)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// inlineCredentialsEnv holds the content of a credentials file, for
+// environments where no file can be mounted.
+const inlineCredentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS_JSON"
+
+// cloudPlatformScope is needed by the base credentials to call the IAM
+// Credentials API when impersonating a service account.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// supportedCredentialTypes are the values of the type field of a credentials
+// file accepted by --gcp.credentials-file.
+var supportedCredentialTypes = map[string]bool{
+	"service_account":  true, // Service account key.
+	"authorized_user":  true, // User credentials created by gcloud.
+	"external_account": true, // Workload Identity Federation configuration.
+}
+
+// credentialsFromFile loads the Google credentials stored in path, a service
+// account key or an external account configuration file.
+func credentialsFromFile(ctx context.Context, path string, scopes ...string) (*google.Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading credentials file: %v", err)
+	}
+	return credentialsFromJSON(ctx, data, "credentials file "+path, scopes...)
+}
+
+// credentialsFromJSON loads the Google credentials in data, read from source.
+func credentialsFromJSON(ctx context.Context, data []byte, source string, scopes ...string) (*google.Credentials, error) {
+	var file struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", source, err)
+	}
+	if !supportedCredentialTypes[file.Type] {
+		return nil, fmt.Errorf("Error loading %s: unsupported credentials type %q", source, file.Type)
+	}
+
+	return google.CredentialsFromJSON(ctx, data, scopes...)
+}
+
+// newTokenSource returns the token source authenticating the calls to the
+// Google API with scopes, impersonating --gcp.impersonate-service-account
+// when set. The credentials are read from credentialsFile, or found in the
+// environment when it is empty.
+func newTokenSource(ctx context.Context, credentialsFile string, scopes []string) (oauth2.TokenSource, error) {
+	if err := validateScopes(scopes); err != nil {
+		return nil, err
+	}
+	baseScopes := scopes
+	if *gcpImpersonateServiceAccount != "" {
+		baseScopes = []string{cloudPlatformScope}
+	}
+
+	// Files take precedence over the inline credentials.
+	var credentials *google.Credentials
+	var err error
+	switch {
+	case credentialsFile != "":
+		credentials, err = credentialsFromFile(ctx, credentialsFile, baseScopes...)
+	case os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" && os.Getenv(inlineCredentialsEnv) != "":
+		credentials, err = credentialsFromJSON(ctx, []byte(os.Getenv(inlineCredentialsEnv)), "$"+inlineCredentialsEnv, baseScopes...)
+	default:
+		credentials, err = google.FindDefaultCredentials(ctx, baseScopes...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if *gcpImpersonateServiceAccount == "" {
+		return credentials.TokenSource, nil
+	}
+	return impersonatedTokenSource(ctx, *gcpImpersonateServiceAccount, *gcpImpersonateDelegates, scopes, option.WithTokenSource(credentials.TokenSource))
+}
+
+// validateScopes checks the OAuth scopes of --gcp.scopes.
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("Error in --gcp.scopes: at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope == "" {
+			return fmt.Errorf("Error in --gcp.scopes: empty scope")
+		}
+	}
+	return nil
+}
+
+// impersonatedTokenSource returns a token source for target with scopes,
+// reached through the delegates chain of service accounts, if any.
+func impersonatedTokenSource(ctx context.Context, target string, delegates, scopes []string, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+	source, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: target,
+		Scopes:          scopes,
+		Delegates:       delegates,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating service account %s: %v", target, err)
+	}
+	return source, nil
+}
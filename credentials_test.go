@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestCredentialsFromFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"authorized user", `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`, ""},
+		{"external account", `{"type": "external_account", "audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider", "subject_token_type": "urn:ietf:params:oauth:token-type:jwt", "token_url": "https://sts.googleapis.com/v1/token", "credential_source": {"file": "/var/run/token"}}`, ""},
+		{"missing type", `{"client_id": "id"}`, `unsupported credentials type ""`},
+		{"unsupported type", `{"type": "gdch_service_account"}`, `unsupported credentials type "gdch_service_account"`},
+		{"invalid json", `{`, "Error parsing credentials file"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "credentials.json")
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := credentialsFromFile(context.Background(), path, compute.ComputeReadonlyScope)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("TestCredentialsFromFile %s: unexpected error: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("TestCredentialsFromFile %s: error=%v, expected=%q", test.name, err, test.err)
+		}
+	}
+}
+
+// roundTripFunc adapts a function to an http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	var request *http.Request
+	var body map[string]interface{}
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		request = req
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"accessToken": "impersonated", "expireTime": "2100-01-01T00:00:00Z"}`)),
+		}, nil
+	})}
+
+	source, err := impersonatedTokenSource(context.Background(), "quota@target.iam.gserviceaccount.com",
+		[]string{"hop@delegate.iam.gserviceaccount.com"}, []string{compute.ComputeReadonlyScope}, option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := source.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.AccessToken != "impersonated" {
+		t.Errorf("TestImpersonatedTokenSource: token=%q, expected=%q", token.AccessToken, "impersonated")
+	}
+	if !strings.Contains(request.URL.Path, "/serviceAccounts/quota@target.iam.gserviceaccount.com:generateAccessToken") {
+		t.Errorf("TestImpersonatedTokenSource: url=%s, expected the target service account", request.URL)
+	}
+	if delegates := fmt.Sprint(body["delegates"]); delegates != "[projects/-/serviceAccounts/hop@delegate.iam.gserviceaccount.com]" {
+		t.Errorf("TestImpersonatedTokenSource: delegates=%s, expected the delegation chain", delegates)
+	}
+	if scopes := fmt.Sprint(body["scope"]); scopes != "["+compute.ComputeReadonlyScope+"]" {
+		t.Errorf("TestImpersonatedTokenSource: scope=%s, expected=[%s]", scopes, compute.ComputeReadonlyScope)
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	if err := validateScopes([]string{compute.ComputeReadonlyScope, cloudPlatformScope}); err != nil {
+		t.Errorf("TestValidateScopes: unexpected error: %v", err)
+	}
+	for _, scopes := range [][]string{nil, {""}, {compute.ComputeReadonlyScope, ""}} {
+		if err := validateScopes(scopes); err == nil {
+			t.Errorf("TestValidateScopes: scopes=%q, expected an error", scopes)
+		}
+	}
+}
+
+func TestNewTokenSourceInline(t *testing.T) {
+	// Empty every other credentials source.
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+
+	t.Setenv(inlineCredentialsEnv, `{"type": "impersonated_service_account"}`)
+	if _, err := newTokenSource(context.Background(), "", []string{compute.ComputeReadonlyScope}); err == nil || !strings.Contains(err.Error(), "$"+inlineCredentialsEnv) {
+		t.Errorf("TestNewTokenSourceInline: error=%v, expected the inline credentials to be used", err)
+	}
+
+	t.Setenv(inlineCredentialsEnv, `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`)
+	if _, err := newTokenSource(context.Background(), "", []string{compute.ComputeReadonlyScope}); err != nil {
+		t.Errorf("TestNewTokenSourceInline: unexpected error: %v", err)
+	}
+
+	// A credentials file takes precedence.
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type": "gdch_service_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+	if _, err := newTokenSource(context.Background(), "", []string{compute.ComputeReadonlyScope}); err == nil || strings.Contains(err.Error(), inlineCredentialsEnv) {
+		t.Errorf("TestNewTokenSourceInline: error=%v, expected $GOOGLE_APPLICATION_CREDENTIALS to take precedence", err)
+	}
+}
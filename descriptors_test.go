@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestDescriptors guards the metric names, help texts and label names exposed
+// by the Exporter, as changing them breaks downstream dashboards. Run
+// `go test -run TestDescriptors -update` after an intended change.
+func TestDescriptors(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.quotaGroups = map[string][]string{"compute-capacity": {"CPUS"}}
+
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		exporter.Describe(ch)
+		close(ch)
+	}()
+
+	seen := make(map[string]bool)
+	var descriptors []string
+	for desc := range ch {
+		if !seen[desc.String()] {
+			seen[desc.String()] = true
+			descriptors = append(descriptors, desc.String())
+		}
+	}
+	sort.Strings(descriptors)
+	got := strings.Join(descriptors, "\n") + "\n"
+
+	const golden = "testdata/descriptors.golden"
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(expected) {
+		t.Errorf("TestDescriptors: metric descriptors changed, run with -update if intended.\ngot:\n%s\nexpected:\n%s", got, expected)
+	}
+}
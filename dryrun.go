@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var dryRun = kingpin.Flag(
+	"dry-run", "Scrape the projects once, print the metrics to stdout in the Prometheus text format and exit, without starting the HTTP server. Exits non-zero when a scrape fails.",
+).Default("false").Bool()
+
+// writeOnce collects es a single time and writes the metrics to w in the
+// Prometheus text format. It fails when a project couldn't be scraped, after
+// writing what was collected.
+func writeOnce(w io.Writer, es exporters) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(uncheckedCollector{es})
+	families, err := registry.Gather()
+	if err != nil {
+		return fmt.Errorf("Error gathering metrics: %v", err)
+	}
+
+	encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return fmt.Errorf("Error writing metrics: %v", err)
+		}
+	}
+
+	for _, e := range es {
+		if !e.lastScrapeSucceeded() {
+			return fmt.Errorf("Error scraping project %s", e.project)
+		}
+	}
+	return nil
+}
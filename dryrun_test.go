@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteOnce(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeOnce(&buf, exporters{newReplayExporter(t, "testdata/fixtures")}); err != nil {
+		t.Fatalf("TestWriteOnce: %v", err)
+	}
+	expected := `gcp_quota_limit{metric="CPUS",project="test-project",region="europe-west1",source="compute"} 24`
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("TestWriteOnce: output doesn't contain %s:\n%s", expected, buf.String())
+	}
+
+	// The metrics of a failed scrape are still written.
+	buf.Reset()
+	if err := writeOnce(&buf, exporters{newReplayExporter(t, t.TempDir())}); err == nil {
+		t.Error("TestWriteOnce: expected an error for a failed scrape")
+	}
+	if !strings.Contains(buf.String(), `gcp_quota_project_up{project="test-project"} 0`) {
+		t.Errorf("TestWriteOnce: output doesn't report the failure:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// nameFilter selects names, such as quota metrics or regions, by include and
+// exclude patterns.
+type nameFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newNameFilter compiles the include and exclude patterns of a filter.
+func newNameFilter(include, exclude []string) (*nameFilter, error) {
+	filter := &nameFilter{}
+	for _, pattern := range include {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, re)
+	}
+	for _, pattern := range exclude {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+	return filter, nil
+}
+
+// compilePattern compiles a filter pattern. A pattern enclosed in slashes,
+// e.g. /^N2_/, is a regular expression matching anywhere in the name. Any
+// other pattern is a glob matching the whole name, where * matches any
+// number of characters and ? a single one.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter pattern %s: %v", pattern, err)
+		}
+		return re, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()), nil
+}
+
+// matches reports whether name passes the filter: it must match one of the
+// include patterns, when there are any, and none of the exclude patterns.
+// Excludes take precedence, so that they can carve exceptions out of the
+// includes. An empty filter matches every name.
+func (f *nameFilter) matches(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestNameFilter(t *testing.T) {
+	filter, err := newNameFilter([]string{"*CPUS*", "/^IN_USE_/"}, []string{"N2_*", "*_ALL_REGIONS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		"CPUS":             true,
+		"C2_CPUS":          true,
+		"N2_CPUS":          false, // excluded despite *CPUS*
+		"CPUS_ALL_REGIONS": false,
+		"IN_USE_ADDRESSES": true,
+		"STATIC_ADDRESSES": false, // not included
+	} {
+		if got := filter.matches(name); got != expected {
+			t.Errorf("TestNameFilter: matches(%q)=%v, expected=%v", name, got, expected)
+		}
+	}
+
+	exclude, err := newNameFilter(nil, []string{"asia-*", "/^europe-west[0-9]+$/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		"us-east1":         true,
+		"asia-east1":       false,
+		"europe-west1":     false,
+		"europe-north1":    true,
+		"us-central1-asia": true,
+	} {
+		if got := exclude.matches(name); got != expected {
+			t.Errorf("TestNameFilter(exclude only): matches(%q)=%v, expected=%v", name, got, expected)
+		}
+	}
+
+	if _, err := newNameFilter([]string{"/(/"}, nil); err == nil {
+		t.Errorf("TestNameFilter: expected an error for an invalid regular expression")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// redactedFields are removed from recorded fixtures as they may hold
+// credentials, SSH keys or identify the account the exporter runs as.
+var redactedFields = map[string]bool{
+	"commonInstanceMetadata": true,
+	"defaultServiceAccount":  true,
+	"usageExportLocation":    true,
+}
+
+var unsafeFixtureChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// fixtureRecorder saves the successful Google API responses passing through
+// it to dir, so that real responses can be replayed in tests.
+type fixtureRecorder struct {
+	base   http.RoundTripper
+	dir    string
+	logger log.Logger
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *fixtureRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	file := filepath.Join(r.dir, fixtureName(req)+".json")
+	if err := writeFixture(file, body); err != nil {
+		level.Error(r.logger).Log("msg", "Unable to record fixture", "file", file, "error", err)
+	} else {
+		level.Info(r.logger).Log("msg", "Recorded fixture", "file", file)
+	}
+	return resp, nil
+}
+
+// fixtureName names the fixture of a request after the resource path below
+// the project, so recordings don't depend on the project they came from:
+// Projects.Get is stored as "project" and Regions.List as "regions".
+func fixtureName(req *http.Request) string {
+	segments := resourcePath(req)
+	name := "project"
+	if len(segments) > 0 {
+		name = strings.Join(segments, "_")
+	}
+	if token := req.URL.Query().Get("pageToken"); token != "" {
+		name += "_" + token
+	}
+	return unsafeFixtureChars.ReplaceAllString(name, "_")
+}
+
+// writeFixture redacts body and writes it to file as indented JSON.
+func writeFixture(file string, body []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+
+	redacted, err := json.MarshalIndent(redact(doc), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(redacted, '\n'), 0644)
+}
+
+// redact removes the redactedFields from a decoded JSON document.
+func redact(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if redactedFields[key] {
+				delete(v, key)
+				continue
+			}
+			v[key] = redact(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	}
+	return doc
+}
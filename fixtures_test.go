@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promlog "github.com/prometheus/common/promlog"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// newReplayServer serves the fixtures recorded in dir with --record-fixtures.
+// Requests without a matching fixture get a 404.
+func newReplayServer(t *testing.T, dir string) *httptest.Server {
+	server := httptest.NewServer(replayHandler(t, dir))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// replayHandler is the handler of newReplayServer, for tests wrapping it.
+func replayHandler(t *testing.T, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadFile(filepath.Join(dir, fixtureName(r)+".json"))
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			t.Errorf("newReplayServer: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// newReplayExporter returns an Exporter of test-project querying a replay
+// server for dir.
+func newReplayExporter(t *testing.T, dir string) *Exporter {
+	return newProjectReplayExporter(t, dir, "test-project")
+}
+
+// newProjectReplayExporter returns an Exporter of project querying a replay
+// server for dir. The fixtures don't depend on the project.
+func newProjectReplayExporter(t *testing.T, dir, project string) *Exporter {
+	return newServerExporter(t, newReplayServer(t, dir), project)
+}
+
+// newServerExporter returns an Exporter of project querying the Compute API
+// served by server.
+func newServerExporter(t *testing.T, server *httptest.Server, project string) *Exporter {
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter, err := newExporter(service, project, promlog.New(&promlog.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exporter
+}
+
+func TestReplayFixtures(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+
+	project, regionList := exporter.scrape(context.Background())
+	if project == nil || regionList == nil {
+		t.Fatalf("TestReplayFixtures: project=%v regionList=%v, expected both to be replayed", project, regionList)
+	}
+
+	// 4 project quotas and 3 quotas in each of the 2 regions.
+	for _, name := range []string{"gcp_quota_limit", "gcp_quota_usage"} {
+		if got := testutil.CollectAndCount(exporter, name); got != 10 {
+			t.Errorf("TestReplayFixtures: %s series=%d, expected=10", name, got)
+		}
+	}
+}
+
+func TestNetworkResources(t *testing.T) {
+	*gcpCountNetworkResources = true
+	defer func() { *gcpCountNetworkResources = false }()
+	exporter := newReplayExporter(t, "testdata/fixtures")
+
+	expected := `
+# HELP gcp_quota_network_subnetworks Number of subnetworks of a network, from listing them.
+# TYPE gcp_quota_network_subnetworks gauge
+gcp_quota_network_subnetworks{network="default",project="test-project"} 2
+gcp_quota_network_subnetworks{network="shared",project="test-project"} 1
+# HELP gcp_quota_resource_count Number of resources counting against a project-wide quota, from listing them.
+# TYPE gcp_quota_resource_count gauge
+gcp_quota_resource_count{project="test-project",quota_metric="FIREWALLS"} 1
+gcp_quota_resource_count{project="test-project",quota_metric="NETWORKS"} 2
+gcp_quota_resource_count{project="test-project",quota_metric="ROUTES"} 0
+gcp_quota_resource_count{project="test-project",quota_metric="SUBNETWORKS"} 3
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_network_subnetworks", "gcp_quota_resource_count"); err != nil {
+		t.Errorf("TestNetworkResources: %v", err)
+	}
+}
+
+func TestLabeledResources(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.resourceLabelKeys = []string{"team", "env"}
+
+	// Resources without a label are counted under an empty label_value. The
+	// Hyperdisk counts against neither DISKS_TOTAL_GB nor SSD_TOTAL_GB.
+	expected := `
+# HELP gcp_quota_labeled_resource_count amount of a quota consumed by resources, grouped by resource label
+# TYPE gcp_quota_labeled_resource_count gauge
+gcp_quota_labeled_resource_count{label_key="env",label_value="",project="test-project",quota_metric="DISKS_TOTAL_GB"} 110
+gcp_quota_labeled_resource_count{label_key="env",label_value="",project="test-project",quota_metric="INSTANCES"} 2
+gcp_quota_labeled_resource_count{label_key="env",label_value="prod",project="test-project",quota_metric="INSTANCES"} 1
+gcp_quota_labeled_resource_count{label_key="env",label_value="prod",project="test-project",quota_metric="SSD_TOTAL_GB"} 510
+gcp_quota_labeled_resource_count{label_key="team",label_value="",project="test-project",quota_metric="DISKS_TOTAL_GB"} 100
+gcp_quota_labeled_resource_count{label_key="team",label_value="",project="test-project",quota_metric="INSTANCES"} 1
+gcp_quota_labeled_resource_count{label_key="team",label_value="data",project="test-project",quota_metric="DISKS_TOTAL_GB"} 10
+gcp_quota_labeled_resource_count{label_key="team",label_value="data",project="test-project",quota_metric="INSTANCES"} 1
+gcp_quota_labeled_resource_count{label_key="team",label_value="data",project="test-project",quota_metric="SSD_TOTAL_GB"} 500
+gcp_quota_labeled_resource_count{label_key="team",label_value="web",project="test-project",quota_metric="INSTANCES"} 1
+gcp_quota_labeled_resource_count{label_key="team",label_value="web",project="test-project",quota_metric="SSD_TOTAL_GB"} 10
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_labeled_resource_count"); err != nil {
+		t.Errorf("TestLabeledResources: %v", err)
+	}
+}
+
+func TestStateLabel(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"project", "regions"} {
+		content, err := ioutil.ReadFile(filepath.Join("testdata/fixtures", name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "regions" {
+			// us-east1 is down.
+			i := strings.Index(string(content), `"name": "us-east1"`)
+			content = []byte(string(content[:i]) + strings.Replace(string(content[i:]), `"status": "UP"`, `"status": "DOWN"`, 1))
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".json"), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	*gcpStateLabel = true
+	defer func() { *gcpStateLabel = false }()
+	exporter := newReplayExporter(t, dir)
+	exporter.metricFilter, _ = filterConfig{Include: []string{"CPUS*"}}.compile()
+
+	// Project quotas have no region, so no state.
+	expected := `
+# HELP gcp_quota_limit quota limits for GCP components
+# TYPE gcp_quota_limit gauge
+gcp_quota_limit{metric="CPUS",project="test-project",region="europe-west1",source="compute",state="UP"} 24
+gcp_quota_limit{metric="CPUS",project="test-project",region="us-east1",source="compute",state="DOWN"} 24
+gcp_quota_limit{metric="CPUS_ALL_REGIONS",project="test-project",region="",source="compute",state=""} 24
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_limit"); err != nil {
+		t.Errorf("TestStateLabel: %v", err)
+	}
+}
+
+func TestFixtureName(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/compute/v1/projects/test-project":                         "project",
+		"/compute/v1/projects/test-project/regions":                 "regions",
+		"/compute/v1/projects/test-project/regions?pageToken=a/b=c": "regions_a_b_c",
+	} {
+		u, err := url.Parse("https://compute.googleapis.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fixtureName(&http.Request{URL: u}); got != expected {
+			t.Errorf("TestFixtureName: %s=%q, expected=%q", path, got, expected)
+		}
+	}
+}
+
+func TestFixtureRecorder(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"test-project","defaultServiceAccount":"123-compute@developer.gserviceaccount.com",` +
+			`"commonInstanceMetadata":{"items":[{"key":"ssh-keys","value":"secret"}]},"quotas":[{"metric":"CPUS","limit":24}]}`))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	client := &http.Client{Transport: &fixtureRecorder{base: http.DefaultTransport, dir: dir, logger: promlog.New(&promlog.Config{})}}
+	resp, err := client.Get(upstream.URL + "/compute/v1/projects/test-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	recorded, err := ioutil.ReadFile(filepath.Join(dir, "project.json"))
+	if err != nil {
+		t.Fatalf("TestFixtureRecorder: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(recorded, &doc); err != nil {
+		t.Fatal(err)
+	}
+	for field := range redactedFields {
+		if _, ok := doc[field]; ok {
+			t.Errorf("TestFixtureRecorder: %s was not redacted", field)
+		}
+	}
+	if doc["name"] != "test-project" || doc["quotas"] == nil {
+		t.Errorf("TestFixtureRecorder: recorded=%s, expected name and quotas to be kept", recorded)
+	}
+}
+
+func TestCachedCollect(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.scrapeInterval = time.Minute
+	exporter.cacheTTL = 3 * time.Minute
+
+	up := func(project, regions int) string {
+		return fmt.Sprintf(`
+# HELP gcp_quota_project_up Was the last scrape of the Google Project API successful.
+# TYPE gcp_quota_project_up gauge
+gcp_quota_project_up{project="test-project"} %d
+# HELP gcp_quota_regions_up Was the last scrape of the Google Regions API successful.
+# TYPE gcp_quota_regions_up gauge
+gcp_quota_regions_up{project="test-project"} %d
+`, project, regions)
+	}
+
+	// Nothing is cached before the first refresh.
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(up(0, 0)), "gcp_quota_project_up", "gcp_quota_regions_up"); err != nil {
+		t.Errorf("TestCachedCollect(before refresh): %v", err)
+	}
+
+	exporter.refresh()
+	// Collect serves the cache without calling the Google API.
+	exporter.service.BasePath = "http://127.0.0.1:1/"
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(up(1, 1)), "gcp_quota_project_up", "gcp_quota_regions_up"); err != nil {
+		t.Errorf("TestCachedCollect(cached): %v", err)
+	}
+	if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != 10 {
+		t.Errorf("TestCachedCollect(cached): gcp_quota_limit series=%d, expected=10", got)
+	}
+	recommended := `
+# HELP gcp_quota_recommended_scrape_interval_seconds Shortest useful Prometheus scrape interval, the --gcp.scrape-interval of the background scrapes.
+# TYPE gcp_quota_recommended_scrape_interval_seconds gauge
+gcp_quota_recommended_scrape_interval_seconds{project="test-project"} 60
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(recommended), "gcp_quota_recommended_scrape_interval_seconds"); err != nil {
+		t.Errorf("TestCachedCollect(cached): %v", err)
+	}
+
+	// A failed refresh keeps the last successful results until they expire.
+	exporter.refresh()
+	exporter.lastRegionListTime = time.Now().Add(-4 * time.Minute)
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(up(1, 0)), "gcp_quota_project_up", "gcp_quota_regions_up"); err != nil {
+		t.Errorf("TestCachedCollect(stale): %v", err)
+	}
+}
+
+func TestDataAge(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.scrapeInterval = time.Minute
+	exporter.cacheTTL = 10 * time.Minute
+	exporter.dataStaleMultiple = 2
+
+	// Nothing is cached before the first refresh.
+	if got := testutil.CollectAndCount(exporter, "gcp_quota_data_age_seconds"); got != 0 {
+		t.Errorf("TestDataAge(before refresh): %d gcp_quota_data_age_seconds series, expected none", got)
+	}
+	expected := `
+# HELP gcp_quota_data_stale Are the cached quotas older than --gcp.data-stale-multiple scrape intervals.
+# TYPE gcp_quota_data_stale gauge
+gcp_quota_data_stale{project="test-project"} %d
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(fmt.Sprintf(expected, 1)), "gcp_quota_data_stale"); err != nil {
+		t.Errorf("TestDataAge(before refresh): %v", err)
+	}
+
+	exporter.refresh()
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(fmt.Sprintf(expected, 0)), "gcp_quota_data_stale"); err != nil {
+		t.Errorf("TestDataAge(fresh): %v", err)
+	}
+
+	// The age is that of the older of the two calls.
+	exporter.lastProjectTime = time.Now().Add(-30 * time.Second)
+	exporter.lastRegionListTime = time.Now().Add(-3 * time.Minute)
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(fmt.Sprintf(expected, 1)), "gcp_quota_data_stale"); err != nil {
+		t.Errorf("TestDataAge(stale): %v", err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(uncheckedCollector{exporter})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "gcp_quota_data_age_seconds" {
+			continue
+		}
+		if age := family.GetMetric()[0].GetGauge().GetValue(); age < 180 || age > 190 {
+			t.Errorf("TestDataAge(stale): gcp_quota_data_age_seconds=%v, expected about 180", age)
+		}
+		return
+	}
+	t.Error("TestDataAge(stale): gcp_quota_data_age_seconds not collected")
+}
+
+func TestNextBoundary(t *testing.T) {
+	now := time.Date(2022, 6, 1, 10, 17, 42, 0, time.UTC)
+	for _, tc := range []struct {
+		interval time.Duration
+		expected time.Time
+	}{
+		{time.Minute, time.Date(2022, 6, 1, 10, 18, 0, 0, time.UTC)},
+		{5 * time.Minute, time.Date(2022, 6, 1, 10, 20, 0, 0, time.UTC)},
+		{time.Hour, time.Date(2022, 6, 1, 11, 0, 0, 0, time.UTC)},
+	} {
+		if got := nextBoundary(now, tc.interval); !got.Equal(tc.expected) {
+			t.Errorf("TestNextBoundary(%v): %v, expected=%v", tc.interval, got, tc.expected)
+		}
+	}
+	// A time on a boundary waits for the next one.
+	if got := nextBoundary(now.Truncate(time.Minute), time.Minute); !got.Equal(now.Truncate(time.Minute).Add(time.Minute)) {
+		t.Errorf("TestNextBoundary(on boundary): %v, expected the next minute", got)
+	}
+}
+
+func TestRefreshDoesNotBlockCollect(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.scrapeInterval = time.Minute
+	exporter.cacheTTL = 3 * time.Minute
+	exporter.refresh()
+
+	// The next refresh hangs in the Google API until released.
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	exporter.service.BasePath = server.URL + "/compute/v1/"
+	refreshed := make(chan struct{})
+	go func() {
+		exporter.refresh()
+		close(refreshed)
+	}()
+	<-started
+
+	collected := make(chan int)
+	go func() { collected <- testutil.CollectAndCount(exporter, "gcp_quota_limit") }()
+	select {
+	case got := <-collected:
+		if got != 10 {
+			t.Errorf("TestRefreshDoesNotBlockCollect: gcp_quota_limit series=%d during a refresh, expected the 10 cached ones", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("TestRefreshDoesNotBlockCollect: collection waited for the background scrape")
+	}
+	close(release)
+	<-refreshed
+}
+
+func TestHealthHandler(t *testing.T) {
+	check := func(exporter *Exporter, expected int, contains string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		healthHandler(exporter.Health)(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != expected || !strings.Contains(rec.Body.String(), contains) {
+			t.Errorf("TestHealthHandler: status=%d body=%q, expected status=%d and a body containing %q", rec.Code, rec.Body.String(), expected, contains)
+		}
+	}
+
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	check(exporter, http.StatusServiceUnavailable, "not been scraped yet")
+	exporter.scrape(context.Background())
+	check(exporter, http.StatusOK, `"status":"ok"`)
+
+	// Without fixtures both calls get a 404.
+	exporter = newReplayExporter(t, t.TempDir())
+	exporter.scrape(context.Background())
+	check(exporter, http.StatusServiceUnavailable, "regions.list")
+}
+
+func TestMetricFilter(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	var err error
+	exporter.metricFilter, err = newNameFilter([]string{"*CPUS*"}, []string{"*_ALL_REGIONS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CPUS in each of the 2 regions, CPUS_ALL_REGIONS is excluded.
+	if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != 2 {
+		t.Errorf("TestMetricFilter: gcp_quota_limit series=%d, expected=2", got)
+	}
+}
+
+func TestRegionFilter(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	var err error
+	exporter.regionFilter, err = newNameFilter(nil, []string{"europe-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 project quotas and the 3 quotas of us-east1.
+	if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != 7 {
+		t.Errorf("TestRegionFilter: gcp_quota_limit series=%d, expected=7", got)
+	}
+}
+
+func TestScrapeRetries(t *testing.T) {
+	replay := newReplayServer(t, "testdata/fixtures")
+	var mutex sync.Mutex
+	failed := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first call of each method with a body that can't be
+		// decoded, which the transport doesn't retry.
+		mutex.Lock()
+		first := !failed[r.URL.Path]
+		failed[r.URL.Path] = true
+		mutex.Unlock()
+		if first {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{"))
+			return
+		}
+		replay.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := newExporter(service, "test-project", promlog.New(&promlog.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter.retries = retryConfig{maxRetries: 0}
+	if project, regionList := exporter.scrape(context.Background()); project != nil || regionList != nil {
+		t.Fatalf("TestScrapeRetries: project=%v regionList=%v, expected the malformed bodies to fail without retries", project, regionList)
+	}
+
+	mutex.Lock()
+	failed = make(map[string]bool)
+	mutex.Unlock()
+	exporter.retries = retryConfig{maxRetries: 1}
+	if project, regionList := exporter.scrape(context.Background()); project == nil || regionList == nil {
+		t.Errorf("TestScrapeRetries: project=%v regionList=%v, expected both to succeed on retry", project, regionList)
+	}
+}
+
+func TestReplayPagedRegions(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures-paged")
+
+	_, regionList := exporter.scrape(context.Background())
+	if regionList == nil || len(regionList.Items) != 2 {
+		t.Fatalf("TestReplayPagedRegions: regionList=%v, expected the 2 regions of both pages", regionList)
+	}
+
+	// 4 project quotas and 3 quotas in the region of each page.
+	for _, name := range []string{"gcp_quota_limit", "gcp_quota_usage"} {
+		if got := testutil.CollectAndCount(exporter, name); got != 10 {
+			t.Errorf("TestReplayPagedRegions: %s series=%d, expected=10", name, got)
+		}
+	}
+}
+
+func TestScrapeErrorLogFields(t *testing.T) {
+	// An empty fixtures directory makes every call fail with a 404.
+	server := newReplayServer(t, t.TempDir())
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	exporter, err := newExporter(service, "test-project", log.NewJSONLogger(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.scrape(context.Background())
+
+	var phases []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("TestScrapeErrorLogFields: log isn't JSON: %v", err)
+		}
+		if entry["project"] != "test-project" {
+			t.Errorf("TestScrapeErrorLogFields: project=%v, expected=test-project in %v", entry["project"], entry)
+		}
+		phases = append(phases, fmt.Sprint(entry["phase"]))
+	}
+	if got := strings.Join(phases, ","); got != "project,region" {
+		t.Errorf("TestScrapeErrorLogFields: phases=%s, expected=project,region", got)
+	}
+}
+
+func TestScrapeErrorClass(t *testing.T) {
+	exporter := newReplayExporter(t, t.TempDir())
+	expected := `
+# HELP gcp_quota_scrape_error Failure class of the last scrape, 1 for the class of its first failed call and 0 otherwise.
+# TYPE gcp_quota_scrape_error gauge
+gcp_quota_scrape_error{project="test-project",reason="auth"} 0
+gcp_quota_scrape_error{project="test-project",reason="not_found"} 1
+gcp_quota_scrape_error{project="test-project",reason="rate_limited"} 0
+gcp_quota_scrape_error{project="test-project",reason="timeout"} 0
+gcp_quota_scrape_error{project="test-project",reason="unknown"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_scrape_error"); err != nil {
+		t.Errorf("TestScrapeErrorClass: %v", err)
+	}
+
+	// A successful scrape clears the failure.
+	exporter.service = newReplayExporter(t, "testdata/fixtures").service
+	expected = strings.Replace(expected, `reason="not_found"} 1`, `reason="not_found"} 0`, 1)
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_scrape_error"); err != nil {
+		t.Errorf("TestScrapeErrorClass: %v", err)
+	}
+}
+
+func TestRegionUp(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	expected := `
+# HELP gcp_quota_region_up Were the quotas of the region read by the last scrape.
+# TYPE gcp_quota_region_up gauge
+gcp_quota_region_up{project="test-project",region="europe-west1"} 1
+gcp_quota_region_up{project="test-project",region="us-east1"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_region_up"); err != nil {
+		t.Errorf("TestRegionUp: %v", err)
+	}
+
+	// No region is up when the list call fails.
+	exporter.service = newReplayExporter(t, t.TempDir()).service
+	if count := testutil.CollectAndCount(exporter, "gcp_quota_region_up"); count != 0 {
+		t.Errorf("TestRegionUp: %d region_up series, expected none", count)
+	}
+}
+
+func TestQuotaUnits(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.quotaUnits = mergeQuotaUnits(map[string]string{"SNAPSHOTS": "snapshots"})
+
+	// --gcp.quota-unit overrides the built-in unit of SNAPSHOTS.
+	expected := `
+# HELP gcp_quota_unit_info unit of the limit and usage of the GCP quota metric
+# TYPE gcp_quota_unit_info gauge
+gcp_quota_unit_info{metric="CPUS",project="test-project",unit="count"} 1
+gcp_quota_unit_info{metric="CPUS_ALL_REGIONS",project="test-project",unit="count"} 1
+gcp_quota_unit_info{metric="DISKS_TOTAL_GB",project="test-project",unit="gigabytes"} 1
+gcp_quota_unit_info{metric="FIREWALLS",project="test-project",unit="count"} 1
+gcp_quota_unit_info{metric="IN_USE_ADDRESSES",project="test-project",unit="count"} 1
+gcp_quota_unit_info{metric="NETWORKS",project="test-project",unit="count"} 1
+gcp_quota_unit_info{metric="SNAPSHOTS",project="test-project",unit="snapshots"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_unit_info"); err != nil {
+		t.Errorf("TestQuotaUnits: %v", err)
+	}
+}
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	lastSuccess := func() float64 {
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(uncheckedCollector{exporter})
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() == "gcp_quota_last_success_timestamp_seconds" {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatal("TestLastSuccessTimestamp: gcp_quota_last_success_timestamp_seconds is missing")
+		return 0
+	}
+
+	exporter.paused = true
+	if got := lastSuccess(); got != 0 {
+		t.Errorf("TestLastSuccessTimestamp: timestamp=%v before any scrape, expected=0", got)
+	}
+
+	exporter.paused = false
+	before := float64(time.Now().Unix())
+	if got := lastSuccess(); got < before {
+		t.Errorf("TestLastSuccessTimestamp: timestamp=%v after a successful scrape, expected>=%v", got, before)
+	}
+
+	// A failed scrape keeps the timestamp of the last successful one.
+	succeeded := lastSuccess()
+	exporter.service = newReplayExporter(t, t.TempDir()).service
+	if got := lastSuccess(); got != succeeded {
+		t.Errorf("TestLastSuccessTimestamp: timestamp=%v after a failed scrape, expected=%v", got, succeeded)
+	}
+}
+
+func TestScrapeDurationPhases(t *testing.T) {
+	// The region list is delayed, the project isn't.
+	handler := replayHandler(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/regions") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	exporter := newServerExporter(t, server, "test-project")
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(uncheckedCollector{exporter})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	durations := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "gcp_quota_scrape_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "phase" {
+					durations[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	if len(durations) != 2 {
+		t.Fatalf("TestScrapeDurationPhases: durations=%v, expected the project and region phases", durations)
+	}
+	if durations["region"] < 0.2 || durations["project"] >= 0.2 {
+		t.Errorf("TestScrapeDurationPhases: durations=%v, expected only the region phase to take 200ms", durations)
+	}
+}
+
+func TestCachedTimestamps(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	// limitTimestamps returns the timestamps of the limit samples by region.
+	limitTimestamps := func() map[string]int64 {
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(uncheckedCollector{exporter})
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamps := make(map[string]int64)
+		for _, family := range families {
+			if family.GetName() != "gcp_quota_limit" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "region" {
+						timestamps[label.GetValue()] = metric.GetTimestampMs()
+					}
+				}
+			}
+		}
+		return timestamps
+	}
+
+	// Live samples, paused or not, are stamped by Prometheus at scrape time.
+	for _, pause := range []bool{false, true} {
+		if pause {
+			exporter.Pause()
+		}
+		for region, timestamp := range limitTimestamps() {
+			if timestamp != 0 {
+				t.Errorf("TestCachedTimestamps: live sample of region %q has timestamp %d (paused=%v)", region, timestamp, pause)
+			}
+		}
+	}
+	exporter.Resume()
+
+	// Cached samples carry the time of the call that returned them.
+	exporter.scrapeInterval = time.Minute
+	exporter.cacheTTL = 3 * time.Minute
+	exporter.refresh()
+	exporter.lastProjectTime = exporter.lastProjectTime.Add(-time.Minute)
+	timestamps := limitTimestamps()
+	if len(timestamps) != 3 {
+		t.Fatalf("TestCachedTimestamps: cached gcp_quota_limit regions=%v, expected the project and 2 regions", timestamps)
+	}
+	for region, timestamp := range timestamps {
+		expected := exporter.lastRegionListTime
+		if region == "" {
+			expected = exporter.lastProjectTime
+		}
+		if timestamp != expected.UnixNano()/int64(time.Millisecond) {
+			t.Errorf("TestCachedTimestamps: cached sample of region %q has timestamp %d, expected=%d", region, timestamp, expected.UnixNano()/int64(time.Millisecond))
+		}
+	}
+}
+
+func TestDiscoveryCounts(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.regionFilter, _ = filterConfig{Include: []string{"europe-west1"}}.compile()
+
+	// Both regions are listed, only the quotas of europe-west1 are exported.
+	expected := `
+# HELP gcp_quota_metrics_total Number of quotas exported by the last scrape, by scope.
+# TYPE gcp_quota_metrics_total gauge
+gcp_quota_metrics_total{project="test-project",scope="project"} 4
+gcp_quota_metrics_total{project="test-project",scope="region"} 3
+# HELP gcp_quota_regions_total Number of regions listed by the last scrape.
+# TYPE gcp_quota_regions_total gauge
+gcp_quota_regions_total{project="test-project"} 2
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_metrics_total", "gcp_quota_regions_total"); err != nil {
+		t.Errorf("TestDiscoveryCounts: %v", err)
+	}
+}
+
+func TestEmptyProjectQuotas(t *testing.T) {
+	dir := t.TempDir()
+	regions, err := ioutil.ReadFile("testdata/fixtures/regions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "regions.json"), regions, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "project.json"), []byte(`{"name": "test-project"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter := newReplayExporter(t, dir)
+	var buf bytes.Buffer
+	exporter.logger = log.NewLogfmtLogger(&buf)
+
+	// The scrape succeeds, the missing quotas show in the count.
+	expected := `
+# HELP gcp_quota_metrics_total Number of quotas exported by the last scrape, by scope.
+# TYPE gcp_quota_metrics_total gauge
+gcp_quota_metrics_total{project="test-project",scope="project"} 0
+gcp_quota_metrics_total{project="test-project",scope="region"} 6
+# HELP gcp_quota_project_up Was the last scrape of the Google Project API successful.
+# TYPE gcp_quota_project_up gauge
+gcp_quota_project_up{project="test-project"} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_metrics_total", "gcp_quota_project_up"); err != nil {
+		t.Errorf("TestEmptyProjectQuotas: %v", err)
+	}
+	if !strings.Contains(buf.String(), `msg="Google API returned no project quotas"`) {
+		t.Errorf("TestEmptyProjectQuotas: no warning logged: %s", buf.String())
+	}
+}
+
+func TestRemovedGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"project", "regions"} {
+		content, err := ioutil.ReadFile(filepath.Join("testdata/fixtures", name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFixture(name, string(content))
+	}
+	exporter := newReplayExporter(t, dir)
+	exporter.gracePeriod = time.Hour
+
+	check := func(step string, limits int, removed string) {
+		t.Helper()
+		if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != limits {
+			t.Errorf("TestRemovedGracePeriod(%s): gcp_quota_limit series=%d, expected=%d", step, got, limits)
+		}
+		if err := testutil.CollectAndCompare(exporter, strings.NewReader(removed), "gcp_quota_removed"); err != nil {
+			t.Errorf("TestRemovedGracePeriod(%s): %v", step, err)
+		}
+	}
+	check("first scrape", 10, "")
+
+	// A failed project call leaves its quotas unknown, not removed.
+	if err := os.Remove(filepath.Join(dir, "project.json")); err != nil {
+		t.Fatal(err)
+	}
+	check("failed scrape", 6, "")
+	if seen := exporter.seen[seriesKey{"", "SNAPSHOTS"}]; seen == nil || time.Since(seen.lastSeen) > time.Minute {
+		t.Errorf("TestRemovedGracePeriod(failed scrape): SNAPSHOTS seen=%+v, expected to be kept", seen)
+	}
+
+	// SNAPSHOTS is no longer returned: its last values are kept during the
+	// grace period.
+	writeFixture("project", `{"name": "test-project", "quotas": [`+
+		`{"metric": "NETWORKS", "limit": 5, "usage": 2},`+
+		`{"metric": "FIREWALLS", "limit": 100, "usage": 17},`+
+		`{"metric": "CPUS_ALL_REGIONS", "limit": 24, "usage": 6}]}`)
+	check("grace period", 10, `
+# HELP gcp_quota_removed The quota is no longer returned by the Google API, its last values are kept during the grace period.
+# TYPE gcp_quota_removed gauge
+gcp_quota_removed{metric="SNAPSHOTS",project="test-project",region=""} 1
+`)
+
+	// It's dropped once the grace period is over.
+	exporter.seen[seriesKey{"", "SNAPSHOTS"}].lastSeen = time.Now().Add(-2 * time.Hour)
+	check("after grace period", 9, "")
+	if _, ok := exporter.seen[seriesKey{"", "SNAPSHOTS"}]; ok {
+		t.Errorf("TestRemovedGracePeriod(after grace period): SNAPSHOTS is still tracked")
+	}
+}
+
+func TestQuotaGroups(t *testing.T) {
+	dir := t.TempDir()
+	regions, err := ioutil.ReadFile("testdata/fixtures/regions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "regions.json"), regions, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Fractional project quotas, whose sums aren't rounded.
+	project := `{"name": "test-project", "quotas": [` +
+		`{"metric": "CPUS", "limit": 10.5, "usage": 1.5},` +
+		`{"metric": "IN_USE_ADDRESSES", "limit": 2.25, "usage": 2.25},` +
+		`{"metric": "SNAPSHOTS", "limit": -1, "usage": 3}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "project.json"), []byte(project), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter := newReplayExporter(t, dir)
+	exporter.quotaGroups = parseQuotaGroups(map[string]string{
+		"compute": "CPUS,IN_USE_ADDRESSES,N2_CPUS",
+		"absent":  "N2_CPUS",
+		"storage": "CPUS,SNAPSHOTS",
+	})
+
+	// N2_CPUS isn't returned by the fixtures and counts as zero. The
+	// unlimited SNAPSHOTS leaves the project storage group without limit.
+	expected := `
+# HELP gcp_quota_group_limit sum of the quota limits of the members of a quota group
+# TYPE gcp_quota_group_limit gauge
+gcp_quota_group_limit{group="absent",project="test-project",region=""} 0
+gcp_quota_group_limit{group="absent",project="test-project",region="europe-west1"} 0
+gcp_quota_group_limit{group="absent",project="test-project",region="us-east1"} 0
+gcp_quota_group_limit{group="compute",project="test-project",region=""} 12.75
+gcp_quota_group_limit{group="compute",project="test-project",region="europe-west1"} 32
+gcp_quota_group_limit{group="compute",project="test-project",region="us-east1"} 32
+gcp_quota_group_limit{group="storage",project="test-project",region="europe-west1"} 24
+gcp_quota_group_limit{group="storage",project="test-project",region="us-east1"} 24
+# HELP gcp_quota_group_usage sum of the quota usage of the members of a quota group
+# TYPE gcp_quota_group_usage gauge
+gcp_quota_group_usage{group="absent",project="test-project",region=""} 0
+gcp_quota_group_usage{group="absent",project="test-project",region="europe-west1"} 0
+gcp_quota_group_usage{group="absent",project="test-project",region="us-east1"} 0
+gcp_quota_group_usage{group="compute",project="test-project",region=""} 3.75
+gcp_quota_group_usage{group="compute",project="test-project",region="europe-west1"} 5
+gcp_quota_group_usage{group="compute",project="test-project",region="us-east1"} 2
+gcp_quota_group_usage{group="storage",project="test-project",region=""} 4.5
+gcp_quota_group_usage{group="storage",project="test-project",region="europe-west1"} 4
+gcp_quota_group_usage{group="storage",project="test-project",region="us-east1"} 2
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_group_limit", "gcp_quota_group_usage"); err != nil {
+		t.Errorf("TestQuotaGroups: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	influxURL = kingpin.Flag(
+		"influx.url", "Base URL of an InfluxDB server to push quota metrics to, e.g. http://influxdb:8086. Disabled when empty.",
+	).Envar("INFLUX_URL").String()
+
+	influxToken = kingpin.Flag(
+		"influx.token", "InfluxDB 2.x API token. ($INFLUX_TOKEN)",
+	).Envar("INFLUX_TOKEN").String()
+
+	influxOrg = kingpin.Flag(
+		"influx.org", "InfluxDB 2.x organization to write to.",
+	).String()
+
+	influxBucket = kingpin.Flag(
+		"influx.bucket", "InfluxDB 2.x bucket to write to.",
+	).String()
+
+	influxDatabase = kingpin.Flag(
+		"influx.database", "InfluxDB 1.x database to write to, used when --influx.bucket is not set.",
+	).Default("gcp_quota").String()
+
+	influxInterval = kingpin.Flag(
+		"influx.interval", "How often quota metrics are pushed to InfluxDB.",
+	).Default("1m").Duration()
+
+	influxBatchSize = kingpin.Flag(
+		"influx.batch-size", "Maximum number of lines sent in a single InfluxDB write request.",
+	).Default("5000").Int()
+)
+
+// influxSink periodically gathers the quota metrics and writes them to
+// InfluxDB using the line protocol.
+type influxSink struct {
+	gatherer  prometheus.Gatherer
+	writeURL  string
+	token     string
+	batchSize int
+	client    *http.Client
+}
+
+// newInfluxSink returns a sink writing the metrics of gatherer to the
+// InfluxDB 2.x API when a bucket is configured, or the 1.x API otherwise.
+func newInfluxSink(gatherer prometheus.Gatherer) (*influxSink, error) {
+	base, err := url.Parse(*influxURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid InfluxDB URL: %v", err)
+	}
+	if *influxBatchSize < 1 {
+		return nil, fmt.Errorf("InfluxDB batch size must be positive")
+	}
+
+	query := url.Values{"precision": {"ns"}}
+	if *influxBucket != "" {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/write"
+		query.Set("org", *influxOrg)
+		query.Set("bucket", *influxBucket)
+	} else {
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/write"
+		query.Set("db", *influxDatabase)
+	}
+	base.RawQuery = query.Encode()
+
+	return &influxSink{
+		gatherer:  gatherer,
+		writeURL:  base.String(),
+		token:     *influxToken,
+		batchSize: *influxBatchSize,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// push gathers the quota metrics and writes them in batches.
+func (s *influxSink) push(now time.Time) error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	lines := influxLines(families, now)
+	for start := 0; start < len(lines); start += s.batchSize {
+		end := start + s.batchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if err := s.write(lines[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *influxSink) write(lines []string) error {
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// influxLines converts the gauge samples of the families selected by
+// pushedMetric to line protocol, one line per sample. The metric name is the
+// measurement, labels become tags and the sample is stored in the "value"
+// field.
+func influxLines(families []*dto.MetricFamily, now time.Time) []string {
+	var lines []string
+	for _, family := range families {
+		if !pushedMetric(family.GetName()) {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			// Stale markers are NaN, which InfluxDB rejects along with the
+			// whole batch.
+			if metric.GetGauge() == nil || math.IsNaN(metric.GetGauge().GetValue()) {
+				continue
+			}
+
+			var line strings.Builder
+			line.WriteString(influxEscape(family.GetName(), ", "))
+
+			labels := metric.GetLabel()
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+			for _, label := range labels {
+				// Influx doesn't allow empty tag values, e.g. the region of project quotas.
+				if label.GetValue() == "" {
+					continue
+				}
+				line.WriteString("," + influxEscape(label.GetName(), ",= ") + "=" + influxEscape(label.GetValue(), ",= "))
+			}
+
+			line.WriteString(" value=" + strconv.FormatFloat(metric.GetGauge().GetValue(), 'g', -1, 64))
+			line.WriteString(" " + strconv.FormatInt(now.UnixNano(), 10))
+			lines = append(lines, line.String())
+		}
+	}
+	return lines
+}
+
+// influxEscape backslash-escapes the characters in special.
+func influxEscape(s, special string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
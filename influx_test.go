@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInfluxLines(t *testing.T) {
+	limit := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gcp_quota_limit"}, []string{"project", "region", "metric"})
+	limit.WithLabelValues("my project", "", "CPUS").Set(24)
+	limit.WithLabelValues("my project", "us-east1", "CPUS").Set(2.5)
+	limit.WithLabelValues("my project", "us-east1", "SNAPSHOTS").Set(math.NaN()) // a stale marker
+	ignored := prometheus.NewGauge(prometheus.GaugeOpts{Name: "gcp_quota_project_up"})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(limit, ignored)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := influxLines(families, time.Unix(1, 0))
+	expected := []string{
+		`gcp_quota_limit,metric=CPUS,project=my\ project value=24 1000000000`,
+		`gcp_quota_limit,metric=CPUS,project=my\ project,region=us-east1 value=2.5 1000000000`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("TestInfluxLines: got %q, expected %q", lines, expected)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("TestInfluxLines: line %d=%q, expected=%q", i, lines[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/compute/v1"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	// labeledResourceDesc is built by setMetricPrefix.
+	labeledResourceDesc *prometheus.Desc
+
+	gcpResourceLabelKeys = kingpin.Flag(
+		"gcp.resource-label-key", "Resource label to group instance and disk quota consumption by. Can be repeated. Lists every instance and disk on each scrape.",
+	).Strings()
+)
+
+// labeledUsage accumulates quota consumption by label key and value.
+type labeledUsage map[string]map[string]float64
+
+func (u labeledUsage) add(keys []string, labels map[string]string, amount float64) {
+	for _, key := range keys {
+		if u[key] == nil {
+			u[key] = make(map[string]float64)
+		}
+		// Resources without the label are counted under an empty value.
+		u[key][labels[key]] += amount
+	}
+}
+
+// getLabeledResources lists the instances and disks of the project and
+// emits how much of the INSTANCES, DISKS_TOTAL_GB and SSD_TOTAL_GB quotas is
+// consumed by each value of the configured resource labels.
+func (e *Exporter) getLabeledResources(ctx context.Context, ch chan<- prometheus.Metric) {
+	if len(e.resourceLabelKeys) == 0 {
+		return
+	}
+
+	instances := make(labeledUsage)
+	err := e.service.Instances.AggregatedList(e.project).Pages(ctx, func(page *compute.InstanceAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, instance := range scoped.Instances {
+				instances.add(e.resourceLabelKeys, instance.Labels, 1)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failure when listing instances", "error", err)
+	} else {
+		e.emitLabeledUsage(ch, "INSTANCES", instances)
+	}
+
+	disks := map[string]labeledUsage{"DISKS_TOTAL_GB": make(labeledUsage), "SSD_TOTAL_GB": make(labeledUsage)}
+	err = e.service.Disks.AggregatedList(e.project).Pages(ctx, func(page *compute.DiskAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, disk := range scoped.Disks {
+				if quotaMetric, ok := diskQuotaMetrics[path.Base(disk.Type)]; ok {
+					disks[quotaMetric].add(e.resourceLabelKeys, disk.Labels, float64(disk.SizeGb))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failure when listing disks", "error", err)
+	} else {
+		for quotaMetric, usage := range disks {
+			e.emitLabeledUsage(ch, quotaMetric, usage)
+		}
+	}
+}
+
+// diskQuotaMetrics maps the persistent disk types to the quota their size
+// counts against. The other types, e.g. Hyperdisks, have quotas of their own
+// and aren't counted.
+var diskQuotaMetrics = map[string]string{
+	"pd-standard": "DISKS_TOTAL_GB",
+	"pd-ssd":      "SSD_TOTAL_GB",
+	"pd-balanced": "SSD_TOTAL_GB",
+}
+
+func (e *Exporter) emitLabeledUsage(ch chan<- prometheus.Metric, quotaMetric string, usage labeledUsage) {
+	for key, values := range usage {
+		for value, amount := range values {
+			ch <- prometheus.MustNewConstMetric(labeledResourceDesc, prometheus.GaugeValue, amount, e.project, quotaMetric, key, value)
+		}
+	}
+}
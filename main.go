@@ -2,38 +2,129 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
-	"github.com/PuerkitoBio/rehttp"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/go-kit/log/level"
-	"github.com/go-kit/log"
-	promlogflag "github.com/prometheus/common/promlog/flag"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	promlog "github.com/prometheus/common/promlog"
+	promlogflag "github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/monitoring/v3"
 	"google.golang.org/api/option"
+	serviceusage "google.golang.org/api/serviceusage/v1beta1"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/tidwall/gjson"
 )
 
+// exporterName names the binary and its build info, exported as
+// gcp_quota_exporter_build_info. Dashboards rely on it, don't change it.
+const exporterName = "gcp_quota_exporter"
+
+// staleNaN is the bit pattern Prometheus uses to mark a series as stale,
+// value.StaleNaN in the Prometheus server.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// unlimitedQuotaLimit is the smallest limit treated as unlimited. The Compute
+// API reports quotas without a ceiling with a limit of -1 or of the largest
+// int64, 9223372036854775807.
+const unlimitedQuotaLimit = float64(math.MaxInt64)
+
+// sourceCompute is the source label value of quotas read from the Compute Engine API.
+const sourceCompute = "compute"
+
+// computeEndpoints maps the values of --gcp.api-version to the Compute Engine
+// API endpoint serving that version. Both decode into the v1 client types.
+var computeEndpoints = map[string]string{
+	"v1":   "https://compute.googleapis.com/compute/v1/",
+	"beta": "https://compute.googleapis.com/compute/beta/",
+}
+
+// defaultMetricPrefix is the default of --web.metric-prefix.
+const defaultMetricPrefix = "gcp_quota"
+
+// metricPrefix starts the name of every metric of the exporter, set with
+// setMetricPrefix.
+var metricPrefix string
+
 var (
-	limitDesc          = prometheus.NewDesc("gcp_quota_limit", "quota limits for GCP components", []string{"project", "region", "metric"}, nil)
-	usageDesc          = prometheus.NewDesc("gcp_quota_usage", "quota usage for GCP components", []string{"project", "region", "metric"}, nil)
-	projectQuotaUpDesc = prometheus.NewDesc("gcp_quota_project_up", "Was the last scrape of the Google Project API successful.", nil, nil)
-	regionsQuotaUpDesc = prometheus.NewDesc("gcp_quota_regions_up", "Was the last scrape of the Google Regions API successful.", nil, nil)
+	quotaLabels = []string{"project", "region", "metric", "source"}
+
+	infoDesc           *prometheus.Desc
+	unitInfoDesc       *prometheus.Desc
+	projectQuotaUpDesc *prometheus.Desc
+	regionsQuotaUpDesc *prometheus.Desc
+	regionUpDesc       *prometheus.Desc
+	groupLimitDesc     *prometheus.Desc
+	groupUsageDesc     *prometheus.Desc
+	unlimitedDesc      *prometheus.Desc
+	removedDesc        *prometheus.Desc
+	scrapeDurationDesc *prometheus.Desc
+	regionsTotalDesc   *prometheus.Desc
+	metricsTotalDesc   *prometheus.Desc
+	lastSuccessDesc    *prometheus.Desc
+	scrapeTimedOutDesc *prometheus.Desc
+	pausedDesc         *prometheus.Desc
+	dataAgeDesc        *prometheus.Desc
+	dataStaleDesc      *prometheus.Desc
+	recommendedDesc    *prometheus.Desc
+	scrapeErrorDesc    *prometheus.Desc
+	configInfoDesc     *prometheus.Desc
+
+	resourceCountDesc      *prometheus.Desc
+	networkSubnetworksDesc *prometheus.Desc
 
-	gcpProjectID = kingpin.Flag(
-		"gcp.project_id", "ID of the Google Project to be monitored. ($GOOGLE_PROJECT_ID)",
-	).Envar("GOOGLE_PROJECT_ID").String()
+	gcpProjectIDs = kingpin.Flag(
+		"gcp.project_id", "ID of the Google Project to be monitored. Can be repeated. ($GOOGLE_PROJECT_ID)",
+	).Envar("GOOGLE_PROJECT_ID").Strings()
+
+	gcpCredentialsFiles = kingpin.Flag(
+		"gcp.credentials-file", "Google credentials file, a service account key or a Workload Identity Federation configuration. Application Default Credentials are used when unset. Can be repeated once per --gcp.project_id, in the same order. ($GCP_EXPORTER_CREDENTIALS_FILE)",
+	).Envar("GCP_EXPORTER_CREDENTIALS_FILE").Strings()
+
+	gcpScopes = kingpin.Flag(
+		"gcp.scopes", "OAuth scope requested for the Google API calls. Can be repeated.",
+	).Default(compute.ComputeReadonlyScope).Strings()
+
+	gcpImpersonateServiceAccount = kingpin.Flag(
+		"gcp.impersonate-service-account", "Email of a service account to impersonate when calling the Google API. ($GCP_EXPORTER_IMPERSONATE_SERVICE_ACCOUNT)",
+	).Envar("GCP_EXPORTER_IMPERSONATE_SERVICE_ACCOUNT").String()
+
+	gcpImpersonateDelegates = kingpin.Flag(
+		"gcp.impersonate-delegate", "Service account of the delegation chain leading to --gcp.impersonate-service-account, in order. Can be repeated.",
+	).Strings()
+
+	gcpProxyURL = kingpin.Flag(
+		"gcp.proxy-url", "Proxy to send the Google API calls through, e.g. http://proxy:3128. Defaults to the HTTPS_PROXY environment variable. ($GCP_EXPORTER_PROXY_URL)",
+	).Envar("GCP_EXPORTER_PROXY_URL").String()
 
 	gcpMaxRetries = kingpin.Flag(
 		"gcp.max-retries", "Max number of retries that should be attempted on 503 errors from gcp. ($GCP_EXPORTER_MAX_RETRIES)",
@@ -51,9 +142,133 @@ var (
 		"gcp.backoff-jitter", "The amount of jitter to introduce in a exp backoff scenario ($GCP_EXPORTER_BACKODFF_JITTER_BASE)",
 	).Envar("GCP_EXPORTER_BACKOFF_JITTER_BASE").Default("1s").Duration()
 
+	gcpMaxRetryAfter = kingpin.Flag(
+		"gcp.max-retry-after", "Longest Retry-After of a 429 or 503 response waited for before retrying, 0 ignores the header. 429 responses with the header are retried too. ($GCP_EXPORTER_MAX_RETRY_AFTER)",
+	).Envar("GCP_EXPORTER_MAX_RETRY_AFTER").Default("30s").Duration()
+
 	gcpRetryStatuses = kingpin.Flag(
 		"gcp.retry-statuses", "The HTTP statuses that should trigger a retry ($GCP_EXPORTER_RETRY_STATUSES)",
 	).Envar("GCP_EXPORTER_RETRY_STATUSES").Default("503").Ints()
+
+	gcpMaxScrapeDuration = kingpin.Flag(
+		"gcp.max-scrape-duration", "Abort a scrape taking longer than this and return the partial results, 0 disables it. ($GCP_EXPORTER_MAX_SCRAPE_DURATION)",
+	).Envar("GCP_EXPORTER_MAX_SCRAPE_DURATION").Default("0s").Duration()
+
+	gcpScrapeTimeout = kingpin.Flag(
+		"gcp.scrape-timeout", "Timeout of each call to the Google API made by a scrape, 0 disables it. ($GCP_EXPORTER_SCRAPE_TIMEOUT)",
+	).Envar("GCP_EXPORTER_SCRAPE_TIMEOUT").Default("30s").Duration()
+
+	gcpBootstrapMaxRetries = kingpin.Flag(
+		"gcp.bootstrap-max-retries", "Max number of retries of the calls made at startup, such as reading the project ID from the metadata server ($GCP_EXPORTER_BOOTSTRAP_MAX_RETRIES)",
+	).Envar("GCP_EXPORTER_BOOTSTRAP_MAX_RETRIES").Default("3").Int()
+
+	gcpMetadataTimeout = kingpin.Flag(
+		"gcp.metadata-timeout", "How long to wait for the metadata server, which gives the project ID when --gcp.project_id isn't set, retries included. ($GCP_EXPORTER_METADATA_TIMEOUT)",
+	).Envar("GCP_EXPORTER_METADATA_TIMEOUT").Default("2s").Duration()
+
+	recordFixtures = kingpin.Flag(
+		"record-fixtures", "Save redacted Google API responses as JSON files in this directory, for use as test fixtures.",
+	).PlaceHolder("DIR").String()
+
+	gcpAPIVersion = kingpin.Flag(
+		"gcp.api-version", "Version of the Compute Engine API to query: v1 (GA) or beta.",
+	).Default("v1").Enum("v1", "beta")
+
+	gcpLimitHelp = kingpin.Flag(
+		"gcp.limit-help", "Help text of the gcp_quota_limit metric.",
+	).Default("quota limits for GCP components").String()
+
+	gcpUsageHelp = kingpin.Flag(
+		"gcp.usage-help", "Help text of the gcp_quota_usage metric.",
+	).Default("quota usage for GCP components").String()
+
+	gcpRemovedGracePeriod = kingpin.Flag(
+		"gcp.removed-grace-period", "How long the last values of quotas no longer returned by the Google API keep being exported, 0 disables it.",
+	).Default("0s").Duration()
+
+	gcpStaleMarkers = kingpin.Flag(
+		"gcp.stale-markers", "Send Prometheus stale markers for quota series that disappear between scrapes. Only sent in protobuf responses.",
+	).Default("false").Bool()
+
+	gcpStateLabel = kingpin.Flag(
+		"gcp.state-label", "Add a state label with the status of the region (UP or DOWN) to the quota metrics.",
+	).Default("false").Bool()
+
+	gcpProjectNumberLabel = kingpin.Flag(
+		"gcp.project-number-label", "Add a project_number label with the numeric project number returned by the Google API to the quota metrics.",
+	).Default("false").Bool()
+
+	webScopeLabel = kingpin.Flag(
+		"web.scope-label", "Add a scope label (project, region or zone) to the quota metrics.",
+	).Default("false").Bool()
+
+	webOpenMetrics = kingpin.Flag(
+		"web.enable-openmetrics", "Serve metrics in the OpenMetrics format to clients that ask for it in their Accept header.",
+	).Default("false").Bool()
+
+	gcpMinLimit = kingpin.Flag(
+		"gcp.min-limit", "Skip quotas whose limit is below this value, 0 disables the filter. Quotas matching --gcp.always-include are always emitted.",
+	).Default("0").Float64()
+
+	gcpMinUtilization = kingpin.Flag(
+		"gcp.min-utilization", "Skip quotas whose usage is below this fraction of their limit, between 0 and 1, 0 disables the filter. Quotas with a limit of 0 or without limit, and quotas matching --gcp.always-include, are always emitted.",
+	).Default("0").Float64()
+
+	gcpAlwaysInclude = kingpin.Flag(
+		"gcp.always-include", "Regular expression of quota metrics that are emitted regardless of the other filters.",
+	).Regexp()
+
+	gcpMetricInclude = kingpin.Flag(
+		"gcp.metric-include", "Only emit quota metrics matching this glob, or regular expression enclosed in slashes. Can be repeated.",
+	).PlaceHolder("PATTERN").Strings()
+
+	gcpMetricExclude = kingpin.Flag(
+		"gcp.metric-exclude", "Skip quota metrics matching this glob, or regular expression enclosed in slashes. Can be repeated. Takes precedence over --gcp.metric-include.",
+	).PlaceHolder("PATTERN").Strings()
+
+	gcpRegionInclude = kingpin.Flag(
+		"gcp.region-include", "Only emit the quotas of regions matching this glob, e.g. us-*, or regular expression enclosed in slashes. Can be repeated.",
+	).PlaceHolder("PATTERN").Strings()
+
+	gcpRegionExclude = kingpin.Flag(
+		"gcp.region-exclude", "Skip the quotas of regions matching this glob, or regular expression enclosed in slashes. Can be repeated. Takes precedence over --gcp.region-include.",
+	).PlaceHolder("PATTERN").Strings()
+
+	gcpSanityMax = kingpin.Flag(
+		"gcp.sanity-max", "Largest plausible value of a quota metric, as METRIC=VALUE. Samples above it are dropped. Can be repeated.",
+	).PlaceHolder("METRIC=VALUE").StringMap()
+
+	gcpDuplicateStrategy = kingpin.Flag(
+		"gcp.duplicate-strategy", "How to merge quotas reported more than once for the same metric and region: last or sum.",
+	).Default("last").Enum("last", "sum")
+
+	gcpScrapeInterval = kingpin.Flag(
+		"gcp.scrape-interval", "Scrape the Google API in the background at this interval and serve the cached results, 0 scrapes on every collect.",
+	).Default("0s").Duration()
+
+	gcpCacheTTL = kingpin.Flag(
+		"gcp.cache-ttl", "How long the cached results of --gcp.scrape-interval are served after the last successful API call, 0 means 3 times the scrape interval.",
+	).Default("0s").Duration()
+
+	gcpAlignRefresh = kingpin.Flag(
+		"gcp.align-refresh", "Run the background scrapes of --gcp.scrape-interval at multiples of the interval on the clock, e.g. at the top of every minute for 1m.",
+	).Default("false").Bool()
+
+	gcpDataStaleMultiple = kingpin.Flag(
+		"gcp.data-stale-multiple", "Multiple of --gcp.scrape-interval past which gcp_quota_data_stale reports the cached quotas as stale.",
+	).Default("2").Float64()
+
+	gcpDropEmptyRegion = kingpin.Flag(
+		"gcp.drop-empty-region", "Don't export the project-wide series (empty region) of quota metrics that are also reported by regions.",
+	).Default("false").Bool()
+
+	gcpQuotaGroups = kingpin.Flag(
+		"gcp.quota-group", "Named group of quota metrics to aggregate, as name=METRIC,METRIC. Can be repeated.",
+	).PlaceHolder("NAME=METRICS").StringMap()
+
+	gcpQuotaUnits = kingpin.Flag(
+		"gcp.quota-unit", "Unit of a quota metric, as METRIC=UNIT, added to or overriding the built-in units. Can be repeated.",
+	).PlaceHolder("METRIC=UNIT").StringMap()
 )
 
 // Exporter collects quota stats from the Google Compute API and exports them using the Prometheus metrics package.
@@ -62,26 +277,381 @@ type Exporter struct {
 	project string
 	mutex   sync.RWMutex
 	logger  log.Logger
+
+	// flight shares the collection in progress with the concurrent Collect
+	// calls.
+	flight singleflight.Group
+
+	// lastMetrics are the metrics of the last collection, replayed to the
+	// push sinks by pushCollector.
+	lastMetricsMutex sync.Mutex
+	lastMetrics      []prometheus.Metric
+	lastMetricsTime  time.Time
+
+	// monitoring replaces service as the source of the quotas when set, see
+	// scrapeMonitoring. source is the value of their source label.
+	monitoring         *monitoring.Service
+	monitoringLookback time.Duration
+	source             string
+
+	limitDesc  *prometheus.Desc
+	usageDesc  *prometheus.Desc
+	stateLabel bool
+	scopeLabel bool
+
+	// utilizationDesc is gcp_quota_utilization_ratio, with the labels of
+	// limitDesc and usageDesc.
+	utilizationDesc *prometheus.Desc
+
+	// projectNumberLabel adds the project_number label, set from the last
+	// successful Projects.Get and empty until one succeeds.
+	projectNumberLabel bool
+	projectNumber      string
+
+	// seen tracks the quotas emitted by previous scrapes, so that removed
+	// quotas can be emitted for gracePeriod. generation identifies the
+	// current Collect.
+	gracePeriod time.Duration
+	seen        map[seriesKey]*seenQuota
+	generation  uint64
+
+	// resourceLabelKeys are the resource labels quota consumption is grouped
+	// by in gcp_quota_labeled_resource_count.
+	resourceLabelKeys []string
+
+	// countNetworkResources lists the network resources of the project, see
+	// getNetworkResources.
+	countNetworkResources bool
+
+	maxScrapeDuration time.Duration
+	scrapeTimeout     time.Duration
+
+	// retries retries the Google API calls failing without an HTTP status,
+	// those with one are retried by the transport.
+	retries retryConfig
+
+	// previousSeries and currentSeries hold the quota series emitted by the
+	// previous and current scrape, to send stale markers for vanished ones.
+	staleMarkers   bool
+	previousSeries map[string]emittedSeries
+	currentSeries  map[string]emittedSeries
+
+	// scrapeStart is the UnixNano time the running scrape started at, or 0
+	// when no scrape is in progress. It is accessed atomically so that it
+	// can be read while a scrape holds the mutex.
+	scrapeStart int64
+
+	// scraped and lastOutcome are the outcome of the last scrape, and
+	// lastSuccess the end of the last one that read both the project and the
+	// regions. They have their own mutex, so that health checks and
+	// collections of the background cache don't wait for a scrape in
+	// progress.
+	outcomeMutex sync.Mutex
+	scraped      bool
+	lastOutcome  scrapeOutcome
+	lastSuccess  time.Time
+
+	// scrapeErrors counts the failed Google API calls by phase, so failure
+	// rates can be alerted on across scrapes.
+	scrapeErrors *prometheus.CounterVec
+
+	duplicateStrategy string
+	duplicates        prometheus.Counter
+
+	minLimit       float64
+	minUtilization float64
+	alwaysInclude  *regexp.Regexp
+
+	// quotaCounts counts the quotas exported by the current Collect by
+	// scope, "project" or "region".
+	quotaCounts map[string]int
+
+	// dropEmptyRegion skips the project-wide quotas also reported by
+	// regions, regionalMetrics holds the metrics of the current scrape.
+	dropEmptyRegion bool
+	regionalMetrics map[string]bool
+
+	// metricFilter and regionFilter come from the --gcp.metric-* and
+	// --gcp.region-* flags, or from the project's entry in the config file.
+	metricFilter *nameFilter
+	regionFilter *nameFilter
+
+	// sanityMax holds the largest plausible value of a quota metric. Larger
+	// samples are assumed to be API errors and are not exported.
+	sanityMax      map[string]float64
+	sanityRejected *prometheus.CounterVec
+
+	// quotaGroups maps a group name to the quota metrics summed into it.
+	quotaGroups map[string][]string
+	// quotaUnits maps quota metrics to their unit, the built-in ones
+	// extended by --gcp.quota-unit.
+	quotaUnits map[string]string
+
+	// paused stops Collect from calling the Google API, serving the results of
+	// the last real scrape instead.
+	paused         bool
+	lastProject    *compute.Project
+	lastRegionList *compute.RegionList
+
+	// With a scrape interval, refresh stores the results of the successful
+	// calls in lastProject and lastRegionList and Collect serves them until
+	// they are older than cacheTTL. Their quota samples are stamped with the
+	// time of the call.
+	scrapeInterval     time.Duration
+	cacheTTL           time.Duration
+	lastProjectTime    time.Time
+	lastRegionListTime time.Time
+	refreshTimedOut    bool
+
+	// alignRefresh aligns the refreshes after the first one on multiples of
+	// scrapeInterval.
+	alignRefresh bool
+
+	// dataStaleMultiple is the number of scrape intervals past which the
+	// cached quotas are reported as stale.
+	dataStaleMultiple float64
+
+	// lastServiceQuotas and lastResourceMetrics hold the Service Usage
+	// quotas and the resource listings of the last refresh, read at
+	// lastResourcesTime. Unlike the quotas, they are replaced by every
+	// refresh, failed calls included.
+	lastServiceQuotas   []serviceQuotas
+	lastResourceMetrics []prometheus.Metric
+	lastResourcesTime   time.Time
+
+	// serviceUsage reads the consumer quotas of services, nil unless
+	// --gcp.services is set. serviceLabel adds the service label to the quota
+	// metrics.
+	serviceUsage *serviceusage.APIService
+	services     []string
+	serviceLabel bool
+}
+
+// seriesKey identifies the limit and usage series of a quota.
+type seriesKey struct {
+	region string
+	metric string
+}
+
+// emittedSeries is a quota limit or usage series sent by a scrape.
+type emittedSeries struct {
+	desc   *prometheus.Desc
+	labels []string
+}
+
+// scrapeOutcome is the outcome of a scrape of the Google API.
+type scrapeOutcome struct {
+	// failures are the failed calls, with their error.
+	failures []string
+	// errorClass is the failure class of the first failed call, empty when
+	// the scrape succeeded.
+	errorClass string
+	// projectDuration and regionDuration are the durations of the
+	// Projects.Get and Regions.List calls, successful or not.
+	projectDuration time.Duration
+	regionDuration  time.Duration
+}
+
+// seenQuota is the last state of a quota returned by the Google API.
+type seenQuota struct {
+	quota      *compute.Quota
+	state      string
+	lastSeen   time.Time
+	generation uint64
 }
 
 // scrape connects to the Google API to retreive quota statistics and record them as metrics.
-func (e *Exporter) scrape() (prj *compute.Project, rgl *compute.RegionList) {
+func (e *Exporter) scrape(ctx context.Context) (prj *compute.Project, rgl *compute.RegionList) {
+	atomic.StoreInt64(&e.scrapeStart, time.Now().UnixNano())
+	defer atomic.StoreInt64(&e.scrapeStart, 0)
 
-	project, err := e.service.Projects.Get(e.project).Do()
-	if err != nil {
-		level.Error(e.logger).Log("msg", "Failure when querying project quotas", "error", err)
-		project = nil
+	if e.monitoring != nil {
+		return e.scrapeMonitoring(ctx)
 	}
 
-	regionList, err := e.service.Regions.List(e.project).Do()
+	// The project and region quotas come from separate calls, there's no
+	// aggregated endpoint returning both. They're made concurrently so that a
+	// scrape takes as long as the slowest of them.
+	var (
+		outcome    scrapeOutcome
+		project    *compute.Project
+		regionList *compute.RegionList
+		regionErr  error
+		wg         sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		regionErr = e.retries.retry(ctx, e.logger, "regions.list", func() (err error) {
+			callCtx, cancel := e.callContext(ctx)
+			defer cancel()
+			regionList, err = e.listRegions(callCtx)
+			return err
+		})
+		outcome.regionDuration = time.Since(start)
+	}()
+
+	start := time.Now()
+	err := e.retries.retry(ctx, e.logger, "projects.get", func() (err error) {
+		callCtx, cancel := e.callContext(ctx)
+		defer cancel()
+		project, err = e.service.Projects.Get(e.project).Context(callCtx).Do()
+		return err
+	})
+	outcome.projectDuration = time.Since(start)
+	wg.Wait()
+
 	if err != nil {
-		level.Error(e.logger).Log("msg", "Failure when querying region quotas", "error", err)
+		reason := errorReason(err)
+		level.Error(e.logger).Log("msg", "Failure when querying project quotas", "phase", "project", "reason", reason, "error", err)
+		outcome.failures = append(outcome.failures, "projects.get: "+err.Error())
+		e.scrapeErrors.WithLabelValues("project", reason).Inc()
+		outcome.errorClass = errorClass(err)
+		project = nil
+	}
+	if regionErr != nil {
+		reason := errorReason(regionErr)
+		level.Error(e.logger).Log("msg", "Failure when querying region quotas", "phase", "region", "reason", reason, "error", regionErr)
+		outcome.failures = append(outcome.failures, "regions.list: "+regionErr.Error())
+		e.scrapeErrors.WithLabelValues("region", reason).Inc()
+		if outcome.errorClass == "" {
+			outcome.errorClass = errorClass(regionErr)
+		}
 		regionList = nil
 	}
 
+	e.recordOutcome(outcome)
 	return project, regionList
 }
 
+// recordOutcome records the outcome of the last scrape for Health and the
+// self-metrics.
+func (e *Exporter) recordOutcome(outcome scrapeOutcome) {
+	e.outcomeMutex.Lock()
+	defer e.outcomeMutex.Unlock()
+	e.scraped = true
+	e.lastOutcome = outcome
+	if len(outcome.failures) == 0 {
+		e.lastSuccess = time.Now()
+	}
+}
+
+// outcome returns the outcome of the last scrape and the end of the last
+// successful one.
+func (e *Exporter) outcome() (scrapeOutcome, time.Time) {
+	e.outcomeMutex.Lock()
+	defer e.outcomeMutex.Unlock()
+	return e.lastOutcome, e.lastSuccess
+}
+
+// Health returns the error of the last scrape of the Google API, empty when
+// both the project and the region calls succeeded.
+func (e *Exporter) Health() string {
+	e.outcomeMutex.Lock()
+	defer e.outcomeMutex.Unlock()
+	if !e.scraped {
+		return "the Google API has not been scraped yet"
+	}
+	return strings.Join(e.lastOutcome.failures, "; ")
+}
+
+// scrapeErrorReasons are the values of the reason label of
+// gcp_quota_scrape_errors_total.
+var scrapeErrorReasons = []string{"permission_denied", "not_found", "timeout", "other"}
+
+// errorReason classifies a failed Google API call. A project the credentials
+// can't read fails with permission_denied or not_found.
+func errorReason(err error) string {
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+		return "permission_denied"
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return "not_found"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// scrapeErrorClasses are the values of the reason label of
+// gcp_quota_scrape_error.
+var scrapeErrorClasses = []string{"auth", "timeout", "rate_limited", "not_found", "unknown"}
+
+// errorClass classifies a failed Google API call for alert routing. The Compute
+// API reports exceeded rate limits with either 429 or 403 and a
+// rateLimitExceeded reason, other 401 and 403 errors are authorization ones.
+func errorClass(err error) string {
+	var apiErr *googleapi.Error
+	var tokenErr *oauth2.RetrieveError
+	switch {
+	case errors.As(err, &apiErr) && isRateLimited(apiErr):
+		return "rate_limited"
+	case errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden):
+		return "auth"
+	case errors.As(err, &tokenErr):
+		return "auth"
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		return "not_found"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+func isRateLimited(err *googleapi.Error) bool {
+	if err.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, item := range err.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// listRegions returns the regions of the project, with the items of all the
+// pages of the response merged into one RegionList.
+func (e *Exporter) listRegions(ctx context.Context) (*compute.RegionList, error) {
+	var regionList *compute.RegionList
+	var regions []*compute.Region
+	err := e.service.Regions.List(e.project).Pages(ctx, func(page *compute.RegionList) error {
+		regionList = page
+		regions = append(regions, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	regionList.Items = regions
+	regionList.NextPageToken = ""
+	return regionList, nil
+}
+
+// callContext bounds a single Google API call by the scrape timeout, so that a
+// hung call fails with a deadline exceeded error instead of blocking Collect.
+func (e *Exporter) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.scrapeTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, e.scrapeTimeout)
+}
+
+// ScrapeInProgressSeconds returns for how long the current scrape has been
+// running, or 0 when no scrape is in progress.
+func (e *Exporter) ScrapeInProgressSeconds() float64 {
+	start := atomic.LoadInt64(&e.scrapeStart)
+	if start == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, start)).Seconds()
+}
+
 // Describe is implemented with DescribeByCollect. That's possible because the
 // Collect method will always return the same metrics with the same descriptors.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
@@ -91,161 +661,1582 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 // Collect will run each time the exporter is polled and will in turn call the
 // Google API for the required statistics.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(context.Background(), ch)
+}
+
+// collect is Collect with the Google API calls bounded by ctx. Collections
+// that start while one of the project is in progress, e.g. from several
+// Prometheus replicas, wait for it and share its metrics instead of calling
+// the Google API again. The shared collection runs with a context detached
+// from theirs, see flightContext.
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	result := <-e.flight.DoChan("", func() (interface{}, error) {
+		flightCtx, cancel := flightContext(ctx)
+		defer cancel()
+		metrics := gatherMetrics(func(ch chan<- prometheus.Metric) {
+			e.collectOnce(flightCtx, ch)
+		})
+		e.recordMetrics(metrics)
+		return metrics, nil
+	})
+
+	for _, metric := range result.Val.([]prometheus.Metric) {
+		ch <- metric
+	}
+}
+
+// flightContext returns the context of a collection shared by concurrent
+// Collect calls, started with ctx. It keeps the deadline of ctx but isn't
+// canceled with it, so that a request that goes away doesn't cut the
+// collection short for the others waiting for it. Without a deadline only
+// --gcp.scrape-timeout bounds the Google API calls.
+func flightContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// recordMetrics keeps the metrics of a collection for recentMetrics.
+func (e *Exporter) recordMetrics(metrics []prometheus.Metric) {
+	e.lastMetricsMutex.Lock()
+	defer e.lastMetricsMutex.Unlock()
+	e.lastMetrics, e.lastMetricsTime = metrics, time.Now()
+}
+
+// recentMetrics returns the metrics of the last collection when it ended
+// less than maxAge ago.
+func (e *Exporter) recentMetrics(maxAge time.Duration) ([]prometheus.Metric, bool) {
+	e.lastMetricsMutex.Lock()
+	defer e.lastMetricsMutex.Unlock()
+	if e.lastMetricsTime.IsZero() || time.Since(e.lastMetricsTime) > maxAge {
+		return nil, false
+	}
+	return e.lastMetrics, true
+}
+
+// gatherMetrics returns the metrics collect sends to its channel.
+func gatherMetrics(collect func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	buffer := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for metric := range buffer {
+			metrics = append(metrics, metric)
+		}
+		close(done)
+	}()
+	collect(buffer)
+	close(buffer)
+	<-done
+	return metrics
+}
+
+// collectOnce scrapes the Google API and sends the metrics to ch.
+func (e *Exporter) collectOnce(ctx context.Context, ch chan<- prometheus.Metric) {
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
-	project, regionList := e.scrape()
+	// Bound the whole collection, so that a slow Google API can't hold the
+	// mutex and block Prometheus past its own scrape timeout. requestCtx
+	// keeps the deadline of the request, to tell which one was exceeded.
+	requestCtx := ctx
+	if e.maxScrapeDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.maxScrapeDuration)
+		defer cancel()
+	}
 
-	if project != nil {
-		for _, quota := range project.Quotas {
-			ch <- prometheus.MustNewConstMetric(limitDesc, prometheus.GaugeValue, quota.Limit, e.project, "", quota.Metric)
-			ch <- prometheus.MustNewConstMetric(usageDesc, prometheus.GaugeValue, quota.Usage, e.project, "", quota.Metric)
-		}
-		ch <- prometheus.MustNewConstMetric(projectQuotaUpDesc, prometheus.GaugeValue, 1)
+	var project *compute.Project
+	var regionList *compute.RegionList
+	if e.paused {
+		project, regionList = e.lastProject, e.lastRegionList
+		ch <- prometheus.MustNewConstMetric(pausedDesc, prometheus.GaugeValue, 1, e.project)
+	} else if e.scrapeInterval > 0 {
+		project, regionList = e.cachedResults()
+		ch <- prometheus.MustNewConstMetric(pausedDesc, prometheus.GaugeValue, 0, e.project)
+		e.getDataAge(ch)
+		ch <- prometheus.MustNewConstMetric(recommendedDesc, prometheus.GaugeValue, e.scrapeInterval.Seconds(), e.project)
 	} else {
-		ch <- prometheus.MustNewConstMetric(projectQuotaUpDesc, prometheus.GaugeValue, 0)
+		project, regionList = e.scrape(ctx)
+		e.lastProject, e.lastRegionList = project, regionList
+		ch <- prometheus.MustNewConstMetric(pausedDesc, prometheus.GaugeValue, 0, e.project)
 	}
 
-	if regionList != nil {
-		for _, region := range regionList.Items {
-			regionName := region.Name
-			for _, quota := range region.Quotas {
-				ch <- prometheus.MustNewConstMetric(limitDesc, prometheus.GaugeValue, quota.Limit, e.project, regionName, quota.Metric)
-				ch <- prometheus.MustNewConstMetric(usageDesc, prometheus.GaugeValue, quota.Usage, e.project, regionName, quota.Metric)
-			}
+	outcome, lastSuccessTime := e.outcome()
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, outcome.projectDuration.Seconds(), e.project, "project")
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, outcome.regionDuration.Seconds(), e.project, "region")
+
+	var lastSuccess float64
+	if !lastSuccessTime.IsZero() {
+		lastSuccess = float64(lastSuccessTime.UnixNano()) / 1e9
+	}
+	ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, lastSuccess, e.project)
+
+	for _, class := range scrapeErrorClasses {
+		var failed float64
+		if class == outcome.errorClass {
+			failed = 1
 		}
-		ch <- prometheus.MustNewConstMetric(regionsQuotaUpDesc, prometheus.GaugeValue, 1)
-	} else {
-		ch <- prometheus.MustNewConstMetric(regionsQuotaUpDesc, prometheus.GaugeValue, 0)
+		ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, failed, e.project, class)
 	}
 
+	e.generation++
+	e.quotaCounts = make(map[string]int)
+	e.getProjectQuotas(ch, project, regionList)
+	e.getRegionQuotas(ch, regionList)
+	e.getDiscoveryCounts(ch, project, regionList)
+	e.getRemovedQuotas(ch, project != nil, regionList != nil)
+	if e.scrapeInterval > 0 {
+		e.getCachedResources(ch)
+	} else if !e.paused {
+		e.getLabeledResources(ctx, ch)
+		e.getServiceQuotas(ctx, ch)
+		e.getNetworkResources(ctx, ch)
+	}
+	// Every quota sample must have been sent by now, so that the series of
+	// this scrape are compared against the previous one.
+	e.getStaleQuotas(ch)
+	e.getQuotaInfo(ch, project, regionList)
+	switch {
+	case requestCtx.Err() == context.DeadlineExceeded:
+		level.Warn(e.logger).Log("msg", "Scrape exceeded the Prometheus scrape timeout, returning partial results")
+		ch <- prometheus.MustNewConstMetric(scrapeTimedOutDesc, prometheus.GaugeValue, 1, e.project)
+	case ctx.Err() == context.DeadlineExceeded || (e.scrapeInterval > 0 && e.refreshTimedOut):
+		level.Warn(e.logger).Log("msg", "Scrape exceeded the maximum duration, returning partial results", "max_scrape_duration", e.maxScrapeDuration)
+		ch <- prometheus.MustNewConstMetric(scrapeTimedOutDesc, prometheus.GaugeValue, 1, e.project)
+	default:
+		ch <- prometheus.MustNewConstMetric(scrapeTimedOutDesc, prometheus.GaugeValue, 0, e.project)
+	}
+	e.scrapeErrors.Collect(ch)
+	ch <- e.duplicates
+	e.sanityRejected.Collect(ch)
 }
 
-// NewExporter returns an initialised Exporter.
-func NewExporter(project string, logger log.Logger) (*Exporter, error) {
-	// Create context and generate compute.Service
+// refresh scrapes the Google API in the background and caches the results of
+// the calls that succeeded, for Collect to serve. The mutex is only held to
+// store the results, so that collections don't wait for the Google API. It
+// does nothing while scraping is paused.
+func (e *Exporter) refresh() {
+	e.mutex.RLock()
+	paused := e.paused
+	e.mutex.RUnlock()
+	if paused {
+		return
+	}
+
 	ctx := context.Background()
+	if e.maxScrapeDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.maxScrapeDuration)
+		defer cancel()
+	}
 
-	googleClient, err := google.DefaultClient(ctx, compute.ComputeReadonlyScope)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating Google client: %v", err)
+	project, regionList := e.scrape(ctx)
+	serviceQuotas := e.readServiceQuotas(ctx)
+	resourceMetrics := gatherMetrics(func(ch chan<- prometheus.Metric) {
+		e.getLabeledResources(ctx, ch)
+		e.getNetworkResources(ctx, ch)
+	})
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	now := time.Now()
+	e.lastServiceQuotas, e.lastResourceMetrics, e.lastResourcesTime = serviceQuotas, resourceMetrics, now
+	if project != nil {
+		e.lastProject, e.lastProjectTime = project, now
+	}
+	if regionList != nil {
+		e.lastRegionList, e.lastRegionListTime = regionList, now
 	}
+	e.refreshTimedOut = ctx.Err() == context.DeadlineExceeded
+}
 
-	googleClient.Timeout = *gcpHttpTimeout
-	googleClient.Transport = rehttp.NewTransport(
-		googleClient.Transport, // need to wrap DefaultClient transport
-		rehttp.RetryAll(
-			rehttp.RetryMaxRetries(*gcpMaxRetries),
-			rehttp.RetryStatuses(*gcpRetryStatuses...)), // Cloud support suggests retrying on 503 errors
-		rehttp.ExpJitterDelay(*gcpBackoffJitterBase, *gcpMaxBackoffDuration), // Set timeout to <10s as that is prom default timeout
-	)
+// refreshPeriodically calls refresh immediately and then every scrape
+// interval until done is closed. With alignRefresh, the refreshes after the
+// first one start on the next boundary of the interval.
+func (e *Exporter) refreshPeriodically(done <-chan struct{}) {
+	if e.alignRefresh {
+		e.refresh()
+		timer := time.NewTimer(time.Until(nextBoundary(time.Now(), e.scrapeInterval)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+			return
+		}
+	}
 
-	computeService, err := compute.NewService(ctx, option.WithHTTPClient(googleClient))
-	if err != nil {
-		level.Error(logger).Log("Unable to create service", "err", err)
-		os.Exit(1)
+	ticker := time.NewTicker(e.scrapeInterval)
+	defer ticker.Stop()
+	for {
+		e.refresh()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
 	}
+}
 
-	return &Exporter{
-		service: computeService,
-		project: project,
-		logger: logger,
-	}, nil
+// nextBoundary returns the first multiple of interval after now, counted
+// from the zero time, so boundaries are the same across replicas: the top of
+// every minute or hour in UTC for intervals dividing them.
+func nextBoundary(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
 }
 
-func GetProjectIdFromMetadata() (string, error) {
-	client := metadata.NewClient(&http.Client{})
+// cachedResults returns the cached results of the last successful calls, or
+// nil for those older than the cache TTL so that their up metric is 0.
+func (e *Exporter) cachedResults() (*compute.Project, *compute.RegionList) {
+	project, regionList := e.lastProject, e.lastRegionList
+	if project != nil && time.Since(e.lastProjectTime) > e.cacheTTL {
+		level.Warn(e.logger).Log("msg", "Cached project quotas are stale", "age", time.Since(e.lastProjectTime), "cache_ttl", e.cacheTTL)
+		project = nil
+	}
+	if regionList != nil && time.Since(e.lastRegionListTime) > e.cacheTTL {
+		level.Warn(e.logger).Log("msg", "Cached region quotas are stale", "age", time.Since(e.lastRegionListTime), "cache_ttl", e.cacheTTL)
+		regionList = nil
+	}
+	return project, regionList
+}
 
-	project_id, err := client.ProjectID()
-	if err != nil {
-		return "", err
+// getDataAge sends the age of the cached quotas, from the older of the last
+// successful Projects.Get and Regions.List calls, and whether it exceeds
+// dataStaleMultiple scrape intervals. Until both calls succeeded there is no
+// age and the quotas are stale.
+func (e *Exporter) getDataAge(ch chan<- prometheus.Metric) {
+	last := e.lastProjectTime
+	if e.lastRegionListTime.Before(last) {
+		last = e.lastRegionListTime
 	}
 
-	return project_id, nil
+	stale := 1.0
+	if !last.IsZero() {
+		age := time.Since(last)
+		ch <- prometheus.MustNewConstMetric(dataAgeDesc, prometheus.GaugeValue, age.Seconds(), e.project)
+		if age.Seconds() <= e.dataStaleMultiple*e.scrapeInterval.Seconds() {
+			stale = 0
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(dataStaleDesc, prometheus.GaugeValue, stale, e.project)
 }
 
-func main() {
+// getCachedResources emits the Service Usage quotas and the resource listings
+// of the last refresh, unless they are older than the cache TTL.
+func (e *Exporter) getCachedResources(ch chan<- prometheus.Metric) {
+	if e.lastResourcesTime.IsZero() {
+		return
+	}
+	if time.Since(e.lastResourcesTime) > e.cacheTTL {
+		level.Warn(e.logger).Log("msg", "Cached resources are stale", "age", time.Since(e.lastResourcesTime), "cache_ttl", e.cacheTTL)
+		return
+	}
+	e.emitServiceQuotas(ch, e.lastServiceQuotas, e.lastResourcesTime)
+	for _, metric := range e.lastResourceMetrics {
+		ch <- metric
+	}
+}
 
-	var (
-		listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9592").String()
-		metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		basePath      = kingpin.Flag("test.base-path", "Change the default googleapis URL (for testing purposes only).").Default("").String()
-		promlogConfig promlog.Config
-	)
+// getQuotaInfo emits info metrics carrying a human readable description and
+// the unit of every quota metric seen in the scrape, for those that are known.
+func (e *Exporter) getQuotaInfo(ch chan<- prometheus.Metric, project *compute.Project, regionList *compute.RegionList) {
+	seen := make(map[string]bool)
+	emit := func(quotas []*compute.Quota) {
+		for _, quota := range quotas {
+			if seen[quota.Metric] {
+				continue
+			}
+			seen[quota.Metric] = true
+			if description, ok := quotaDescriptions[quota.Metric]; ok {
+				ch <- prometheus.MustNewConstMetric(infoDesc, prometheus.GaugeValue, 1, e.project, quota.Metric, description)
+			}
+			if unit, ok := e.quotaUnits[quota.Metric]; ok {
+				ch <- prometheus.MustNewConstMetric(unitInfoDesc, prometheus.GaugeValue, 1, e.project, quota.Metric, unit)
+			}
+		}
+	}
 
+	if project != nil {
+		emit(project.Quotas)
+	}
+	if regionList != nil {
+		for _, region := range regionList.Items {
+			if e.regionFilter.matches(region.Name) {
+				emit(region.Quotas)
+			}
+		}
+	}
+}
 
-	promlogflag.AddFlags(kingpin.CommandLine, &promlogConfig)
-	kingpin.Version(version.Print("gcp_quota_exporter"))
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+// getProjectQuotas emits the project-wide quotas along with the project up metric.
+func (e *Exporter) getProjectQuotas(ch chan<- prometheus.Metric, project *compute.Project, regionList *compute.RegionList) {
+	if project == nil {
+		ch <- prometheus.MustNewConstMetric(projectQuotaUpDesc, prometheus.GaugeValue, 0, e.project)
+		return
+	}
 
-	logger := promlog.New(&promlogConfig)
+	if project.Id != 0 {
+		e.projectNumber = strconv.FormatUint(project.Id, 10)
+	}
+	e.regionalMetrics = nil
+	if e.dropEmptyRegion {
+		e.regionalMetrics = regionalMetrics(regionList)
+	}
+	// A successful call without quotas points at a misconfigured project or
+	// an API change, rather than at a project without quotas.
+	if len(project.Quotas) == 0 {
+		level.Warn(e.logger).Log("msg", "Google API returned no project quotas", "phase", "project")
+	}
+	e.emitQuotas(ch, "", "", project.Quotas)
+	ch <- prometheus.MustNewConstMetric(projectQuotaUpDesc, prometheus.GaugeValue, 1, e.project)
+}
 
-	level.Info(logger).Log("msg", "Starting gcp_quota_exporter", "version", version.Info())
-	level.Info(logger).Log("Build Context", version.BuildContext())
+// getDiscoveryCounts emits how many regions were listed and how many quotas
+// were exported, for the calls that succeeded. A sudden drop points at a
+// truncated response or an API change.
+func (e *Exporter) getDiscoveryCounts(ch chan<- prometheus.Metric, project *compute.Project, regionList *compute.RegionList) {
+	if project != nil {
+		ch <- prometheus.MustNewConstMetric(metricsTotalDesc, prometheus.GaugeValue, float64(e.quotaCounts["project"]), e.project, "project")
+	}
+	if regionList != nil {
+		ch <- prometheus.MustNewConstMetric(regionsTotalDesc, prometheus.GaugeValue, float64(len(regionList.Items)), e.project)
+		ch <- prometheus.MustNewConstMetric(metricsTotalDesc, prometheus.GaugeValue, float64(e.quotaCounts["region"]), e.project, "region")
+	}
+}
 
-	// Detect Project ID
-	if *gcpProjectID == "" {
-		credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+// regionalMetrics returns the set of quota metrics reported by regions.
+func regionalMetrics(regionList *compute.RegionList) map[string]bool {
+	regional := make(map[string]bool)
+	if regionList == nil {
+		return regional
+	}
+	for _, region := range regionList.Items {
+		for _, quota := range region.Quotas {
+			regional[quota.Metric] = true
+		}
+	}
+	return regional
+}
 
-		if credentialsFile != "" {
-			c, err := ioutil.ReadFile(credentialsFile)
-			if err != nil {
-				level.Error(logger).Log("msg", "Unable to read credentials file",
-					"file", credentialsFile, "error", err)
-				os.Exit(1)
-			}
+// getRegionQuotas emits the quotas of every region along with the regions
+// and region up metrics. No region is up when the list call failed.
+func (e *Exporter) getRegionQuotas(ch chan<- prometheus.Metric, regionList *compute.RegionList) {
+	if regionList == nil {
+		ch <- prometheus.MustNewConstMetric(regionsQuotaUpDesc, prometheus.GaugeValue, 0, e.project)
+		return
+	}
 
-			projectId := gjson.GetBytes(c, "project_id")
+	for _, region := range regionList.Items {
+		if !e.regionFilter.matches(region.Name) {
+			continue
+		}
+		e.emitQuotas(ch, region.Name, region.Status, region.Quotas)
+		// Regions.List returns the quotas of every region at once, so all
+		// listed regions are up. Reading regions separately would allow
+		// some of them to fail.
+		ch <- prometheus.MustNewConstMetric(regionUpDesc, prometheus.GaugeValue, 1, e.project, region.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(regionsQuotaUpDesc, prometheus.GaugeValue, 1, e.project)
+}
 
-			if projectId.String() == "" {
-				level.Error(logger).Log("msg", "Could not retrieve Project ID from credentials file", "file", credentialsFile)
-				os.Exit(1)
-			}
+// emitQuotas sends the limit and usage metrics for the quotas of a single
+// region, or of the project itself when region is empty. state is the
+// status of the region, e.g. UP or DOWN.
+func (e *Exporter) emitQuotas(ch chan<- prometheus.Metric, region, state string, quotas []*compute.Quota) {
+	quotas, duplicates := dedupeQuotas(quotas, e.duplicateStrategy)
+	if duplicates > 0 {
+		level.Warn(e.logger).Log("msg", "Google API returned duplicate quota metrics", "region", region, "duplicates", duplicates)
+		e.duplicates.Add(float64(duplicates))
+	}
 
-			*gcpProjectID = projectId.String()
+	for _, quota := range quotas {
+		if !e.includeQuota(quota) || region == "" && e.regionalMetrics[quota.Metric] {
+			continue
+		}
+		if region == "" {
+			e.quotaCounts["project"]++
 		} else {
-			project_id, err := GetProjectIdFromMetadata()
-			if err != nil {
-				level.Error(logger).Log("error", err)
-				os.Exit(1)
-			}
-
-			*gcpProjectID = project_id
+			e.quotaCounts["region"]++
+		}
+		limitOK := e.plausible(region, quota.Metric, "limit", quota.Limit)
+		if limitOK {
+			e.emitQuotaSample(ch, e.limitDesc, quota.Limit, e.quotaLabelValues(region, state, quota.Metric), e.cacheTime(region))
+		}
+		usageOK := e.plausible(region, quota.Metric, "usage", quota.Usage)
+		if usageOK {
+			e.emitQuotaSample(ch, e.usageDesc, quota.Usage, e.quotaLabelValues(region, state, quota.Metric), e.cacheTime(region))
+		}
+		if limitOK && usageOK {
+			e.emitQuotaSample(ch, e.utilizationDesc, utilization(quota), e.quotaLabelValues(region, state, quota.Metric), e.cacheTime(region))
+		}
+		if unlimited(quota) {
+			ch <- prometheus.MustNewConstMetric(unlimitedDesc, prometheus.GaugeValue, 1, e.project, region, quota.Metric)
+		}
+		if e.gracePeriod > 0 {
+			e.seen[seriesKey{region, quota.Metric}] = &seenQuota{quota: quota, state: state, lastSeen: time.Now(), generation: e.generation}
 		}
 	}
+	e.emitQuotaGroups(ch, region, quotas)
+}
 
-	if *gcpProjectID == "" {
-		level.Error(logger).Log("msg", "GCP Project ID cannot be empty")
-		os.Exit(1)
+// emitQuotaSample sends a quota limit or usage sample, remembering the series
+// when stale markers are enabled. A sample served from the background cache
+// carries fetched, the time the Google API returned it, so that the TSDB shows
+// how old it is. Live samples have a zero fetched and no timestamp.
+func (e *Exporter) emitQuotaSample(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels []string, fetched time.Time) {
+	metric := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	if !fetched.IsZero() {
+		metric = prometheus.NewMetricWithTimestamp(fetched, metric)
 	}
-
-	exporter, err := NewExporter(*gcpProjectID, logger)
-	if err != nil {
-		level.Error(logger).Log("error", err)
-		os.Exit(1)
+	ch <- metric
+	if e.staleMarkers {
+		e.currentSeries[desc.String()+strings.Join(labels, "\xff")] = emittedSeries{desc, labels}
 	}
+}
 
-	if *basePath != "" {
-		exporter.service.BasePath = *basePath
+// cacheTime returns when the cached quotas of region, or the project-wide ones
+// when region is empty, were read from the Google API. It is zero without a
+// scrape interval, as the quotas are then read by the collection itself.
+func (e *Exporter) cacheTime(region string) time.Time {
+	if e.scrapeInterval <= 0 {
+		return time.Time{}
+	}
+	if region == "" {
+		return e.lastProjectTime
 	}
+	return e.lastRegionListTime
+}
 
-	prometheus.MustRegister(exporter)
-	prometheus.MustRegister(version.NewCollector("gcp_quota_exporter"))
+// staleMarker is a sample with the stale marker value, left out of the
+// responses in text formats by requestCollector.
+type staleMarker struct {
+	prometheus.Metric
+}
+
+// getStaleQuotas sends a Prometheus stale marker for every quota series
+// emitted by the previous scrape but not by this one.
+func (e *Exporter) getStaleQuotas(ch chan<- prometheus.Metric) {
+	if !e.staleMarkers {
+		return
+	}
+
+	for key, series := range e.previousSeries {
+		if _, ok := e.currentSeries[key]; !ok {
+			ch <- staleMarker{prometheus.MustNewConstMetric(series.desc, prometheus.GaugeValue, math.Float64frombits(staleNaN), series.labels...)}
+		}
+	}
+	e.previousSeries, e.currentSeries = e.currentSeries, make(map[string]emittedSeries)
+}
+
+// getRemovedQuotas keeps emitting the last values of quotas that are no
+// longer returned by the Google API until they have been gone for the grace
+// period, marking them with gcp_quota_removed. Scopes whose API call failed
+// are skipped, as their quotas are unknown rather than removed.
+func (e *Exporter) getRemovedQuotas(ch chan<- prometheus.Metric, projectUp, regionsUp bool) {
+	if e.gracePeriod <= 0 {
+		return
+	}
+
+	for key, seen := range e.seen {
+		if seen.generation == e.generation {
+			continue
+		}
+		if (key.region == "" && !projectUp) || (key.region != "" && !regionsUp) {
+			continue
+		}
+		if time.Since(seen.lastSeen) > e.gracePeriod {
+			delete(e.seen, key)
+			continue
+		}
+
+		labels := e.quotaLabelValues(key.region, seen.state, key.metric)
+		e.emitQuotaSample(ch, e.limitDesc, seen.quota.Limit, labels, e.cacheTime(key.region))
+		e.emitQuotaSample(ch, e.usageDesc, seen.quota.Usage, labels, e.cacheTime(key.region))
+		e.emitQuotaSample(ch, e.utilizationDesc, utilization(seen.quota), labels, e.cacheTime(key.region))
+		ch <- prometheus.MustNewConstMetric(removedDesc, prometheus.GaugeValue, 1, e.project, key.region, key.metric)
+	}
+}
+
+// quotaLabelValues returns the label values of a quota limit or usage metric
+// read from the Compute Engine API, or from Cloud Monitoring where the metric
+// is prefixed with its service, e.g. pubsub.googleapis.com/topics.
+func (e *Exporter) quotaLabelValues(region, state, metric string) []string {
+	service := computeServiceName
+	if e.source == sourceMonitoring {
+		service = strings.SplitN(metric, "/", 2)[0]
+	}
+	return e.sourceQuotaLabelValues(e.source, service, region, state, metric)
+}
+
+// sourceQuotaLabelValues returns the label values of a quota limit or usage
+// metric read from source for service.
+func (e *Exporter) sourceQuotaLabelValues(source, service, region, state, metric string) []string {
+	values := []string{e.project, region, metric, source}
+	if e.stateLabel {
+		values = append(values, state)
+	}
+	if e.serviceLabel {
+		values = append(values, service)
+	}
+	if e.scopeLabel {
+		values = append(values, quotaScope(region))
+	}
+	if e.projectNumberLabel {
+		values = append(values, e.projectNumber)
+	}
+	return values
+}
+
+// utilization returns the usage of quota as a fraction of its limit. Quotas
+// with a limit of 0, or an unlimited one, have a utilization of 0 rather than
+// NaN or a meaningless ratio.
+func utilization(quota *compute.Quota) float64 {
+	if quota.Limit == 0 || unlimited(quota) {
+		return 0
+	}
+	return quota.Usage / quota.Limit
+}
+
+// zonePattern matches zone names, a region name followed by the zone letter.
+var zonePattern = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
+
+// quotaScope returns the value of the scope label of a quota of region. The
+// Compute API only reports project and region quotas, Cloud Monitoring also
+// has zonal ones.
+func quotaScope(region string) string {
+	switch {
+	case region == "":
+		return "project"
+	case zonePattern.MatchString(region):
+		return "zone"
+	default:
+		return "region"
+	}
+}
+
+// plausible checks value against the configured sanity bound of metric,
+// counting and logging samples that exceed it.
+func (e *Exporter) plausible(region, metric, kind string, value float64) bool {
+	max, ok := e.sanityMax[metric]
+	if !ok || value <= max {
+		return true
+	}
+
+	level.Warn(e.logger).Log("msg", "Dropping implausible quota value", "region", region, "metric", metric, "kind", kind, "value", value, "max", max)
+	e.sanityRejected.WithLabelValues(metric).Inc()
+	return false
+}
+
+// unlimited reports whether the limit of quota is a sentinel meaning it has
+// no ceiling, which would make usage ratios meaningless.
+func unlimited(quota *compute.Quota) bool {
+	return quota.Limit < 0 || quota.Limit >= unlimitedQuotaLimit
+}
+
+// includeQuota applies the quota filters. A match of --gcp.always-include
+// takes precedence over the metric filter, --gcp.min-limit and
+// --gcp.min-utilization.
+func (e *Exporter) includeQuota(quota *compute.Quota) bool {
+	if !e.includeLimit(quota) {
+		return false
+	}
+	if e.alwaysInclude != nil && e.alwaysInclude.MatchString(quota.Metric) {
+		return true
+	}
+	return e.minUtilization <= 0 || quota.Limit == 0 || unlimited(quota) || quota.Usage/quota.Limit >= e.minUtilization
+}
+
+// includeLimit applies the quota filters that don't need the usage of quota,
+// the only ones that apply to the Service Usage quotas.
+func (e *Exporter) includeLimit(quota *compute.Quota) bool {
+	if e.alwaysInclude != nil && e.alwaysInclude.MatchString(quota.Metric) {
+		return true
+	}
+	if !e.metricFilter.matches(quota.Metric) {
+		return false
+	}
+	return e.minLimit <= 0 || quota.Limit >= e.minLimit
+}
+
+// dedupeQuotas merges quotas sharing the same metric name, which would
+// otherwise fail the whole scrape with a duplicate series error. With the
+// "sum" strategy limits and usage are added up, otherwise the last entry
+// wins. It returns the merged quotas and the number of duplicates dropped.
+func dedupeQuotas(quotas []*compute.Quota, strategy string) ([]*compute.Quota, int) {
+	index := make(map[string]int, len(quotas))
+	merged := make([]*compute.Quota, 0, len(quotas))
+	for _, quota := range quotas {
+		i, seen := index[quota.Metric]
+		if !seen {
+			index[quota.Metric] = len(merged)
+			merged = append(merged, quota)
+			continue
+		}
+		if strategy == "sum" {
+			merged[i] = &compute.Quota{
+				Metric: quota.Metric,
+				Owner:  quota.Owner,
+				Limit:  merged[i].Limit + quota.Limit,
+				Usage:  merged[i].Usage + quota.Usage,
+			}
+		} else {
+			merged[i] = quota
+		}
+	}
+	return merged, len(quotas) - len(merged)
+}
+
+// emitQuotaGroups sums the quotas belonging to each configured group. Members
+// missing from quotas count as zero. A group with an unlimited member has no
+// limit.
+func (e *Exporter) emitQuotaGroups(ch chan<- prometheus.Metric, region string, quotas []*compute.Quota) {
+	if len(e.quotaGroups) == 0 {
+		return
+	}
+
+	byMetric := make(map[string]*compute.Quota, len(quotas))
+	for _, quota := range quotas {
+		byMetric[quota.Metric] = quota
+	}
+
+	for group, members := range e.quotaGroups {
+		var limit, usage float64
+		var unlimitedMember bool
+		for _, member := range members {
+			if quota, ok := byMetric[member]; ok {
+				limit += quota.Limit
+				usage += quota.Usage
+				unlimitedMember = unlimitedMember || unlimited(quota)
+			}
+		}
+		// The sums aren't rounded: integer counts add up exactly below 2^53,
+		// and rounding would corrupt fractional quotas such as GB limits.
+		// The sentinel of an unlimited member would make the sum
+		// meaningless, the group has no limit either.
+		if !unlimitedMember {
+			ch <- prometheus.MustNewConstMetric(groupLimitDesc, prometheus.GaugeValue, limit, e.project, region, group)
+		}
+		ch <- prometheus.MustNewConstMetric(groupUsageDesc, prometheus.GaugeValue, usage, e.project, region, group)
+	}
+}
+
+// Pause stops the exporter from querying the Google API. Until Resume is
+// called, Collect serves the data from the last real scrape.
+func (e *Exporter) Pause() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.paused = true
+}
+
+// Resume restarts querying the Google API on each Collect.
+func (e *Exporter) Resume() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.paused = false
+}
+
+// newExporters returns the Exporters of projects, sending the Google API calls
+// to basePath when it isn't empty.
+func newExporters(projects []projectConfig, logger log.Logger, basePath string) (exporters, error) {
+	var es exporters
+	for _, project := range projects {
+		e, err := NewExporter(project.ID, project.CredentialsFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		// Filters set in the config file replace those of the flags.
+		if project.regionFilter != nil {
+			e.regionFilter = project.regionFilter
+		}
+		if project.metricFilter != nil {
+			e.metricFilter = project.metricFilter
+		}
+
+		if basePath != "" {
+			e.service.BasePath = basePath
+		}
+		es = append(es, e)
+		level.Info(logger).Log("msg", "Monitoring Google Project", "project", project.ID)
+	}
+	return es, nil
+}
+
+// NewExporter returns an initialised Exporter.
+func NewExporter(project, credentialsFile string, logger log.Logger) (*Exporter, error) {
+	clients, err := newGoogleClients(logger, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return newClientsExporter(clients, project, logger)
+}
+
+// googleClients are the Google API clients an Exporter reads the quotas
+// with. They aren't tied to a project, so probes can share them.
+type googleClients struct {
+	compute      *compute.Service
+	serviceUsage *serviceusage.APIService
+	monitoring   *monitoring.Service
+}
+
+// newGoogleClients returns the clients needed by the flags, authenticated
+// with credentialsFile. serviceUsage is nil without --gcp.services and
+// monitoring is nil unless --gcp.source=monitoring.
+func newGoogleClients(logger log.Logger, credentialsFile string) (googleClients, error) {
+	var clients googleClients
+	var err error
+	if clients.compute, err = newComputeService(logger, credentialsFile); err != nil {
+		return clients, err
+	}
+	if len(*gcpServices) > 0 {
+		if clients.serviceUsage, err = newServiceUsageService(logger, credentialsFile); err != nil {
+			return clients, err
+		}
+	}
+	if *gcpSource == sourceMonitoring {
+		if clients.monitoring, err = newMonitoringService(logger, credentialsFile); err != nil {
+			return clients, err
+		}
+	}
+	return clients, nil
+}
+
+// newClientsExporter returns an Exporter of project reading the quotas with
+// clients.
+func newClientsExporter(clients googleClients, project string, logger log.Logger) (*Exporter, error) {
+	exporter, err := newExporter(clients.compute, project, logger)
+	if err != nil {
+		return nil, err
+	}
+	exporter.serviceUsage = clients.serviceUsage
+	if clients.monitoring != nil {
+		exporter.monitoring = clients.monitoring
+		exporter.monitoringLookback = *gcpMonitoringLookback
+		exporter.source = sourceMonitoring
+	}
+	return exporter, nil
+}
+
+// clients returns the Google API clients of e.
+func (e *Exporter) clients() googleClients {
+	return googleClients{compute: e.service, serviceUsage: e.serviceUsage, monitoring: e.monitoring}
+}
+
+// newComputeService returns an authenticated Compute Engine API client. It
+// isn't tied to a project and can be shared by several Exporters.
+func newComputeService(logger log.Logger, credentialsFile string) (*compute.Service, error) {
+	googleClient, err := newGoogleClient(logger, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return newComputeClient(googleClient)
+}
+
+// newComputeClient returns a Compute Engine API client sending its calls with
+// client to the endpoint of --gcp.api-version.
+func newComputeClient(client *http.Client) (*compute.Service, error) {
+	computeService, err := compute.NewService(context.Background(),
+		option.WithHTTPClient(client),
+		option.WithEndpoint(computeEndpoints[*gcpAPIVersion]))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Compute service: %v", err)
+	}
+
+	return computeService, nil
+}
+
+// newGoogleClient returns the HTTP client the Google API calls are sent with,
+// authenticated with credentialsFile, retrying them and recording their status.
+func newGoogleClient(logger log.Logger, credentialsFile string) (*http.Client, error) {
+	ctx := context.Background()
+
+	// Credentials are looked up again whenever a token is rejected, which
+	// forces a fresh token to be minted.
+	base, err := baseTransport(*gcpProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &statusTransport{base: base}
+	if *recordFixtures != "" {
+		if err := os.MkdirAll(*recordFixtures, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating fixtures directory: %v", err)
+		}
+		transport = &fixtureRecorder{base: transport, dir: *recordFixtures, logger: logger}
+	}
+
+	scopes := *gcpScopes
+	if len(*gcpServices) > 0 {
+		scopes = append(scopes[:len(scopes):len(scopes)], serviceusage.CloudPlatformReadOnlyScope)
+	}
+	authTransport, err := newAuthRetryTransport(transport, func() (oauth2.TokenSource, error) {
+		return newTokenSource(ctx, credentialsFile, scopes)
+	}, logger)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Google client: %v", err)
+	}
+
+	googleClient := &http.Client{Timeout: *gcpHttpTimeout}
+	googleClient.Transport = scrapeRetryConfig().transport(authTransport)
+	return googleClient, nil
+}
+
+func init() {
+	setMetricPrefix(defaultMetricPrefix)
+}
+
+// validateMetricPrefix checks that prefix can start a Prometheus metric name.
+func validateMetricPrefix(prefix string) error {
+	if !model.IsValidMetricName(model.LabelValue(prefix)) || strings.HasSuffix(prefix, "_") {
+		return fmt.Errorf("Invalid metric prefix %q: must match %s and not end with an underscore", prefix, model.MetricNameRE)
+	}
+	return nil
+}
+
+// setMetricPrefix rebuilds the descriptors and the API metrics with names
+// starting with prefix. It must be called before any Exporter is created or
+// metric registered.
+func setMetricPrefix(prefix string) {
+	metricPrefix = prefix
+	labeledResourceDesc = prometheus.NewDesc(prefix+"_labeled_resource_count", "amount of a quota consumed by resources, grouped by resource label", []string{"project", "quota_metric", "label_key", "label_value"}, nil)
+	infoDesc = prometheus.NewDesc(prefix+"_info", "description of the GCP quota metric", []string{"project", "metric", "description"}, nil)
+	unitInfoDesc = prometheus.NewDesc(prefix+"_unit_info", "unit of the limit and usage of the GCP quota metric", []string{"project", "metric", "unit"}, nil)
+	projectQuotaUpDesc = prometheus.NewDesc(prefix+"_project_up", "Was the last scrape of the Google Project API successful.", []string{"project"}, nil)
+	regionsQuotaUpDesc = prometheus.NewDesc(prefix+"_regions_up", "Was the last scrape of the Google Regions API successful.", []string{"project"}, nil)
+	regionUpDesc = prometheus.NewDesc(prefix+"_region_up", "Were the quotas of the region read by the last scrape.", []string{"project", "region"}, nil)
+	groupLimitDesc = prometheus.NewDesc(prefix+"_group_limit", "sum of the quota limits of the members of a quota group", []string{"project", "region", "group"}, nil)
+	groupUsageDesc = prometheus.NewDesc(prefix+"_group_usage", "sum of the quota usage of the members of a quota group", []string{"project", "region", "group"}, nil)
+	unlimitedDesc = prometheus.NewDesc(prefix+"_unlimited", "The quota has no effective limit, its limit is a sentinel value.", []string{"project", "region", "metric"}, nil)
+	removedDesc = prometheus.NewDesc(prefix+"_removed", "The quota is no longer returned by the Google API, its last values are kept during the grace period.", []string{"project", "region", "metric"}, nil)
+	scrapeDurationDesc = prometheus.NewDesc(prefix+"_scrape_duration_seconds", "Time spent in the last call to the Google API, by phase.", []string{"project", "phase"}, nil)
+	regionsTotalDesc = prometheus.NewDesc(prefix+"_regions_total", "Number of regions listed by the last scrape.", []string{"project"}, nil)
+	metricsTotalDesc = prometheus.NewDesc(prefix+"_metrics_total", "Number of quotas exported by the last scrape, by scope.", []string{"project", "scope"}, nil)
+	lastSuccessDesc = prometheus.NewDesc(prefix+"_last_success_timestamp_seconds", "Unix time of the last scrape that read both the project and the regions, 0 if none did.", []string{"project"}, nil)
+	scrapeTimedOutDesc = prometheus.NewDesc(prefix+"_scrape_timed_out", "Was the last scrape aborted for exceeding its deadline, --gcp.max-scrape-duration or the Prometheus scrape timeout.", []string{"project"}, nil)
+	pausedDesc = prometheus.NewDesc(prefix+"_paused", "Is scraping of the Google APIs currently paused.", []string{"project"}, nil)
+	dataAgeDesc = prometheus.NewDesc(prefix+"_data_age_seconds", "Age of the cached quotas, since the older of the last successful background scrapes of the project and its regions.", []string{"project"}, nil)
+	recommendedDesc = prometheus.NewDesc(prefix+"_recommended_scrape_interval_seconds", "Shortest useful Prometheus scrape interval, the --gcp.scrape-interval of the background scrapes.", []string{"project"}, nil)
+	dataStaleDesc = prometheus.NewDesc(prefix+"_data_stale", "Are the cached quotas older than --gcp.data-stale-multiple scrape intervals.", []string{"project"}, nil)
+	serviceUpDesc = prometheus.NewDesc(prefix+"_service_up", "Was the last scrape of the Service Usage API for the service successful.", []string{"project", "service"}, nil)
+	scrapeErrorDesc = prometheus.NewDesc(prefix+"_scrape_error", "Failure class of the last scrape, 1 for the class of its first failed call and 0 otherwise.", []string{"project", "reason"}, nil)
+	configInfoDesc = prometheus.NewDesc(prefix+"_config_info", "Effective configuration of the exporter, without credentials or file paths.", []string{"projects", "config_file", "source", "api_version", "http_timeout", "scrape_timeout", "max_scrape_duration", "concurrency", "scrape_interval", "cache_ttl"}, nil)
+
+	resourceCountDesc = prometheus.NewDesc(prefix+"_resource_count", "Number of resources counting against a project-wide quota, from listing them.", []string{"project", "quota_metric"}, nil)
+	networkSubnetworksDesc = prometheus.NewDesc(prefix+"_network_subnetworks", "Number of subnetworks of a network, from listing them.", []string{"project", "network"}, nil)
+
+	setAPIMetricsPrefix(prefix)
+}
+
+// effectiveCacheTTL returns --gcp.cache-ttl, or 3 times --gcp.scrape-interval
+// when it isn't set.
+func effectiveCacheTTL() time.Duration {
+	if *gcpCacheTTL > 0 {
+		return *gcpCacheTTL
+	}
+	return 3 * *gcpScrapeInterval
+}
+
+// newExporter returns an Exporter querying service, configured from the
+// command line flags.
+func newExporter(computeService *compute.Service, project string, logger log.Logger) (*Exporter, error) {
+	sanityMax, err := parseSanityMax(*gcpSanityMax)
+	if err != nil {
+		return nil, err
+	}
+	if *gcpMinUtilization < 0 || *gcpMinUtilization > 1 {
+		return nil, fmt.Errorf("Invalid --gcp.min-utilization %v: must be between 0 and 1", *gcpMinUtilization)
+	}
+
+	metricFilter, err := newNameFilter(*gcpMetricInclude, *gcpMetricExclude)
+	if err != nil {
+		return nil, err
+	}
+
+	regionFilter, err := newNameFilter(*gcpRegionInclude, *gcpRegionExclude)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := quotaLabels
+	if *gcpStateLabel {
+		labels = append(labels[:len(labels):len(labels)], "state")
+	}
+	if len(*gcpServices) > 0 {
+		labels = append(labels[:len(labels):len(labels)], "service")
+	}
+	if *webScopeLabel {
+		labels = append(labels[:len(labels):len(labels)], "scope")
+	}
+	if *gcpProjectNumberLabel {
+		labels = append(labels[:len(labels):len(labels)], "project_number")
+	}
+
+	return &Exporter{
+		service:     computeService,
+		project:     project,
+		logger:      log.With(logger, "project", project),
+		source:      sourceCompute,
+		limitDesc:   prometheus.NewDesc(metricPrefix+"_limit", *gcpLimitHelp, labels, nil),
+		usageDesc:   prometheus.NewDesc(metricPrefix+"_usage", *gcpUsageHelp, labels, nil),
+		stateLabel:  *gcpStateLabel,
+		scopeLabel:  *webScopeLabel,
+		gracePeriod: *gcpRemovedGracePeriod,
+
+		services:     *gcpServices,
+		serviceLabel: len(*gcpServices) > 0,
+
+		utilizationDesc: prometheus.NewDesc(metricPrefix+"_utilization_ratio", "quota usage divided by the limit, 0 when the limit is 0 or unlimited", labels, nil),
+
+		scrapeInterval:    *gcpScrapeInterval,
+		cacheTTL:          effectiveCacheTTL(),
+		alignRefresh:      *gcpAlignRefresh,
+		dataStaleMultiple: *gcpDataStaleMultiple,
+
+		projectNumberLabel: *gcpProjectNumberLabel,
+
+		resourceLabelKeys:     *gcpResourceLabelKeys,
+		countNetworkResources: *gcpCountNetworkResources,
+		maxScrapeDuration:     *gcpMaxScrapeDuration,
+		scrapeTimeout:         *gcpScrapeTimeout,
+		retries:               scrapeRetryConfig(),
+
+		staleMarkers:   *gcpStaleMarkers,
+		previousSeries: make(map[string]emittedSeries),
+		currentSeries:  make(map[string]emittedSeries),
+		seen:           make(map[seriesKey]*seenQuota),
+		quotaGroups:    parseQuotaGroups(*gcpQuotaGroups),
+		quotaUnits:     mergeQuotaUnits(*gcpQuotaUnits),
+
+		minLimit:        *gcpMinLimit,
+		minUtilization:  *gcpMinUtilization,
+		dropEmptyRegion: *gcpDropEmptyRegion,
+		alwaysInclude:   *gcpAlwaysInclude,
+		metricFilter:    metricFilter,
+		regionFilter:    regionFilter,
+
+		sanityMax: sanityMax,
+		sanityRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        metricPrefix + "_sanity_rejected_total",
+			Help:        "Number of quota samples dropped for exceeding their configured sanity bound.",
+			ConstLabels: prometheus.Labels{"project": project},
+		}, []string{"metric"}),
+
+		duplicateStrategy: *gcpDuplicateStrategy,
+		duplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        metricPrefix + "_duplicate_metrics_total",
+			Help:        "Number of duplicate quota metrics returned by the Google API and merged.",
+			ConstLabels: prometheus.Labels{"project": project},
+		}),
+		scrapeErrors: newScrapeErrors(project),
+	}, nil
+}
+
+// newScrapeErrors returns the gcp_quota_scrape_errors_total counter, with
+// every phase and reason initialized so they're exported before the first
+// failure.
+func newScrapeErrors(project string) *prometheus.CounterVec {
+	scrapeErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        metricPrefix + "_scrape_errors_total",
+		Help:        "Number of failed calls to the Google API, by phase and reason.",
+		ConstLabels: prometheus.Labels{"project": project},
+	}, []string{"phase", "reason"})
+	for _, phase := range []string{"project", "region", "monitoring"} {
+		for _, reason := range scrapeErrorReasons {
+			scrapeErrors.WithLabelValues(phase, reason)
+		}
+	}
+	return scrapeErrors
+}
+
+// mergeQuotaUnits returns the built-in quota units with those of the
+// --gcp.quota-unit flag added, the flag taking precedence.
+func mergeQuotaUnits(units map[string]string) map[string]string {
+	merged := make(map[string]string, len(quotaUnits)+len(units))
+	for metric, unit := range quotaUnits {
+		merged[metric] = unit
+	}
+	for metric, unit := range units {
+		merged[metric] = unit
+	}
+	return merged
+}
+
+// parseQuotaGroups splits the comma separated member lists of the
+// --gcp.quota-group flag.
+func parseQuotaGroups(groups map[string]string) map[string][]string {
+	parsed := make(map[string][]string, len(groups))
+	for name, members := range groups {
+		for _, member := range strings.Split(members, ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				parsed[name] = append(parsed[name], member)
+			}
+		}
+	}
+	return parsed
+}
+
+// parseSanityMax parses the values of the --gcp.sanity-max flag.
+func parseSanityMax(bounds map[string]string) (map[string]float64, error) {
+	parsed := make(map[string]float64, len(bounds))
+	for metric, value := range bounds {
+		max, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sanity bound for %s: %v", metric, err)
+		}
+		parsed[metric] = max
+	}
+	return parsed, nil
+}
+
+// GetProjectIdFromMetadata reads the project ID from the metadata server.
+// Outside of Google Cloud the server is unreachable, so detection gives up
+// after --gcp.metadata-timeout, retries included, instead of waiting for the
+// system timeouts.
+func GetProjectIdFromMetadata() (string, error) {
+	client := metadata.NewClient(&http.Client{Transport: bootstrapRetryConfig().transport(http.DefaultTransport)})
+
+	type result struct {
+		projectID string
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		projectID, err := client.ProjectID()
+		done <- result{projectID, err}
+	}()
+
+	var err error
+	select {
+	case r := <-done:
+		if r.err == nil {
+			return r.projectID, nil
+		}
+		err = r.err
+	case <-time.After(*gcpMetadataTimeout):
+		err = fmt.Errorf("no answer within --gcp.metadata-timeout=%v", *gcpMetadataTimeout)
+	}
+	return "", fmt.Errorf("Error reading the project ID from the metadata server, set --gcp.project_id when running outside of Google Cloud: %v", err)
+}
+
+// newBuildInfoGauge returns gcp_quota_exporter_build_info, the gauge of
+// version.NewCollector with a constant value of 1, labelled with the release
+// version information and, when the binary was built from a git checkout,
+// the VCS details reported by runtime/debug.
+func newBuildInfoGauge() prometheus.Gauge {
+	labels := prometheus.Labels{
+		"version":   version.Version,
+		"revision":  version.Revision,
+		"branch":    version.Branch,
+		"goversion": version.GoVersion,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				labels["vcs_revision"] = setting.Value
+			case "vcs.modified":
+				labels["vcs_modified"] = setting.Value
+			}
+		}
+	}
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        exporterName + "_build_info",
+		Help:        fmt.Sprintf("A metric with a constant '1' value labeled by version, revision, branch, and goversion from which %s was built.", exporterName),
+		ConstLabels: labels,
+	})
+	gauge.Set(1)
+	return gauge
+}
+
+// lastScrapeSucceeded reports whether both the project and the regions were
+// read by the last scrape.
+func (e *Exporter) lastScrapeSucceeded() bool {
+	return e.Health() == ""
+}
+
+// quotaMetrics returns the distinct quota metric names of the last scrape by
+// scope, "project" or "region".
+func (e *Exporter) quotaMetrics() map[string][]string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	names := func(seen map[string]bool) []string {
+		sorted := make([]string, 0, len(seen))
+		for name := range seen {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		return sorted
+	}
+
+	project := make(map[string]bool)
+	if e.lastProject != nil {
+		for _, quota := range e.lastProject.Quotas {
+			project[quota.Metric] = true
+		}
+	}
+	return map[string][]string{
+		"project": names(project),
+		"region":  names(regionalMetrics(e.lastRegionList)),
+	}
+}
+
+// quotasHandler serves the quota metric names of the last scrape of every
+// project as JSON, without calling the Google API.
+func quotasHandler(es exporterSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		quotas := make(map[string]map[string][]string)
+		for _, e := range es.current() {
+			quotas[e.project] = e.quotaMetrics()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quotas)
+	}
+}
+
+// landingPage is the HTML served at /. html/template escapes the values.
+var landingPage = template.Must(template.New("landing").Parse(`<html>
+<head><title>GCP Quota Exporter</title></head>
+<body>
+<h1>GCP Quota Exporter</h1>
+<p>Version: {{.Version}}</p>
+<p><a href="{{.MetricsPath}}">Metrics</a></p>
+<table>
+<tr><th>Project</th><th>Last scrape</th></tr>
+{{range .Projects}}<tr><td>{{.ID}}</td><td>{{if .Up}}succeeded{{else}}failed{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type landingProject struct {
+	ID string
+	Up bool
+}
+
+// landingHandler serves the landing page listing the monitored projects and
+// whether their last scrape succeeded, as HTML or plain text.
+func landingHandler(es exporterSource, metricsPath, format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var projects []landingProject
+		for _, e := range es.current() {
+			projects = append(projects, landingProject{ID: e.project, Up: e.lastScrapeSucceeded()})
+		}
+
+		if format == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "GCP Quota Exporter\nVersion: %s\nMetrics: %s\n", version.Info(), metricsPath)
+			for _, project := range projects {
+				status := "failed"
+				if project.Up {
+					status = "succeeded"
+				}
+				fmt.Fprintf(w, "Project: %s (last scrape %s)\n", project.ID, status)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingPage.Execute(w, struct {
+			Version     string
+			MetricsPath string
+			Projects    []landingProject
+		}{version.Info(), metricsPath, projects})
+	}
+}
+
+// scrapeTimeoutOffset is subtracted from the scrape timeout sent by
+// Prometheus, leaving time to write the response.
+const scrapeTimeoutOffset = 500 * time.Millisecond
+
+// metricsHandler serves the metrics of es along with those of the default
+// registry. The Google API calls are bounded by the
+// X-Prometheus-Scrape-Timeout-Seconds header, so that a slow scrape returns
+// partial results before Prometheus gives up on it.
+func metricsHandler(es exporterSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if timeout, ok := prometheusScrapeTimeout(r); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		registry := prometheus.NewRegistry()
+		format := expfmt.Negotiate(r.Header)
+		if *webOpenMetrics {
+			format = expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		}
+		registry.MustRegister(requestCollector{es: es.current(), ctx: ctx, staleMarkers: format == expfmt.FmtProtoDelim})
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{EnableOpenMetrics: *webOpenMetrics}).ServeHTTP(w, r)
+	}
+}
+
+// prometheusScrapeTimeout returns the scrape timeout sent by Prometheus, less
+// scrapeTimeoutOffset when it is longer than that.
+func prometheusScrapeTimeout(r *http.Request) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return timeout, true
+}
+
+// requestCollector collects es with the context of a single request. Like
+// uncheckedCollector it has no descriptors, as describing an Exporter scrapes
+// the Google API.
+type requestCollector struct {
+	es  exporters
+	ctx context.Context
+
+	// staleMarkers is set when the response can carry stale markers, which
+	// only the protobuf format preserves.
+	staleMarkers bool
+}
+
+// Describe implements prometheus.Collector.
+func (requestCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c requestCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.staleMarkers {
+		c.es.collect(c.ctx, ch)
+	} else {
+		// Text formats would turn the stale markers into plain NaN samples.
+		for _, metric := range gatherMetrics(func(ch chan<- prometheus.Metric) { c.es.collect(c.ctx, ch) }) {
+			if _, ok := metric.(staleMarker); !ok {
+				ch <- metric
+			}
+		}
+	}
+	ch <- configInfo(len(c.es))
+}
+
+// configInfo returns the gcp_quota_config_info metric for the current flags
+// and number of projects. Only whether a config file is used is exported,
+// not its path.
+func configInfo(projects int) prometheus.Metric {
+	return prometheus.MustNewConstMetric(configInfoDesc, prometheus.GaugeValue, 1,
+		strconv.Itoa(projects),
+		strconv.FormatBool(*configFile != ""),
+		*gcpSource,
+		*gcpAPIVersion,
+		gcpHttpTimeout.String(),
+		gcpScrapeTimeout.String(),
+		gcpMaxScrapeDuration.String(),
+		strconv.Itoa(*gcpConcurrency),
+		gcpScrapeInterval.String(),
+		effectiveCacheTTL().String(),
+	)
+}
+
+// lifecycleHandler returns a handler that runs action on POST requests.
+func lifecycleHandler(action func(), logger log.Logger, msg string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		action()
+		level.Info(logger).Log("msg", msg)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// healthHandler answers 200 when health reports that the last scrape of the
+// Google API succeeded, and 503 with the error otherwise.
+func healthHandler(health func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := struct {
+			Status string `json:"status"`
+			Error  string `json:"error,omitempty"`
+		}{Status: "ok"}
+		code := http.StatusOK
+		if status.Error = health(); status.Error != "" {
+			status.Status = "error"
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// basicAuthHandler wraps next, answering requests without the given basic
+// authentication credentials with a 401.
+func basicAuthHandler(next http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		// Both are compared every time, so the response time doesn't tell
+		// which one was wrong.
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gcp_quota_exporter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tlsEnabled tells whether HTTPS is served with certFile and keyFile. They are
+// loaded to fail at startup rather than on the first connection. Only one of
+// them is warned about and serves plain HTTP.
+func tlsEnabled(certFile, keyFile string, logger log.Logger) (bool, error) {
+	if certFile == "" || keyFile == "" {
+		if certFile != "" || keyFile != "" {
+			level.Warn(logger).Log("msg", "TLS needs both --web.tls-cert-file and --web.tls-key-file, serving plain HTTP")
+		}
+		return false, nil
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return false, err
+	}
+	level.Info(logger).Log("msg", "TLS enabled", "cert_file", certFile)
+	return true, nil
+}
+
+// readPassword reads the basic authentication password from file, ignoring
+// a trailing newline.
+func readPassword(file string) (string, error) {
+	password, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Error reading the password file: %v", err)
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// shutdownOnSignal gracefully shuts down server when a signal is received,
+// giving in-flight requests up to timeout to complete. The returned channel
+// is closed once the shutdown is over.
+func shutdownOnSignal(server *http.Server, signals <-chan os.Signal, timeout time.Duration, logger log.Logger) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := <-signals
+		level.Info(logger).Log("msg", "Shutting down", "signal", sig, "timeout", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			level.Error(logger).Log("msg", "Error during shutdown", "error", err)
+			return
+		}
+		level.Info(logger).Log("msg", "Shutdown complete")
+	}()
+	return done
+}
+
+func main() {
+
+	var (
+		listenAddress   = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9592").String()
+		metricsPath     = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		basePath        = kingpin.Flag("test.base-path", "Change the default googleapis URL (for testing purposes only).").Default("").String()
+		enableLifecycle = kingpin.Flag("web.enable-lifecycle", "Enable the /-/pause, /-/resume and /-/reload endpoints.").Default("false").Bool()
+		rootFormat      = kingpin.Flag("web.root-format", "Format of the landing page served at /: html or text.").Default("html").Enum("html", "text")
+		tlsCertFile     = kingpin.Flag("web.tls-cert-file", "Path to the TLS certificate to serve HTTPS with, along with --web.tls-key-file.").String()
+		tlsKeyFile      = kingpin.Flag("web.tls-key-file", "Path to the TLS private key to serve HTTPS with, along with --web.tls-cert-file.").String()
+		authUsername    = kingpin.Flag("web.auth-username", "Username required by HTTP basic authentication on the metrics and lifecycle endpoints, along with --web.auth-password-file.").String()
+		authPassword    = kingpin.Flag("web.auth-password-file", "Path to a file holding the basic authentication password.").String()
+		shutdownTimeout = kingpin.Flag("web.shutdown-timeout", "How long in-flight requests are given to complete on SIGTERM or SIGINT.").Default("10s").Duration()
+		prefix          = kingpin.Flag("web.metric-prefix", "Prefix of the names of the metrics of the exporter.").Default(defaultMetricPrefix).String()
+		promlogConfig   promlog.Config
+	)
+
+	promlogflag.AddFlags(kingpin.CommandLine, &promlogConfig)
+	kingpin.Version(version.Print(exporterName))
+	kingpin.HelpFlag.Short('h')
+	kingpin.Parse()
+
+	logger := promlog.New(&promlogConfig)
+
+	level.Info(logger).Log("msg", "Starting "+exporterName, "version", version.Info())
+	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
+
+	if err := validateMetricPrefix(*prefix); err != nil {
+		level.Error(logger).Log("error", err)
+		os.Exit(1)
+	}
+	setMetricPrefix(*prefix)
+
+	// The config file takes precedence over the single project flags.
+	exporter := &exporterSet{}
+	if *configFile != "" {
+		exporter.load = func() (exporters, error) {
+			return loadExporters(logger, *basePath)
+		}
+		if err := exporter.reload(); err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+	} else {
+		projectIDs := *gcpProjectIDs
+
+		// Detect Project ID
+		if len(projectIDs) == 0 {
+			var projectID string
+			credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+			if credentialsFile != "" {
+				c, err := ioutil.ReadFile(credentialsFile)
+				if err != nil {
+					level.Error(logger).Log("msg", "Unable to read credentials file",
+						"file", credentialsFile, "error", err)
+					os.Exit(1)
+				}
+
+				projectId := gjson.GetBytes(c, "project_id")
+
+				if projectId.String() == "" {
+					level.Error(logger).Log("msg", "Could not retrieve Project ID from credentials file", "file", credentialsFile)
+					os.Exit(1)
+				}
+
+				projectID = projectId.String()
+			} else if inline := os.Getenv(inlineCredentialsEnv); inline != "" {
+				projectID = gjson.Get(inline, "project_id").String()
+			} else {
+				project_id, err := GetProjectIdFromMetadata()
+				if err != nil {
+					level.Error(logger).Log("error", err)
+					os.Exit(1)
+				}
+
+				projectID = project_id
+			}
+			projectIDs = []string{projectID}
+		}
+
+		projects, err := flagProjects(projectIDs)
+		if err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+		if err := assignCredentialsFiles(projects, *gcpCredentialsFiles, false); err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+		if exporter.es, err = newExporters(projects, logger, *basePath); err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dryRun {
+		// Scrape the Google API right away rather than in the background.
+		for _, e := range exporter.current() {
+			e.scrapeInterval = 0
+		}
+		if err := writeOnce(os.Stdout, exporter.current()); err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *gcpScrapeInterval > 0 {
+		level.Info(logger).Log("msg", "Scraping the Google API in the background", "interval", *gcpScrapeInterval)
+		exporter.refreshPeriodically()
+	}
+
+	// The exporter is collected by metricsHandler, with the scrape timeout of
+	// the request.
+	prometheus.MustRegister(newBuildInfoGauge())
+	prometheus.MustRegister(apiLastStatus, apiRequests, apiRequestDuration)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: metricPrefix + "_scrape_in_progress_seconds",
+		Help: "How long the scrape of the Google API currently in progress has been running, 0 when idle.",
+	}, exporter.ScrapeInProgressSeconds))
+
+	if *influxURL != "" {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(pushCollector{es: exporter, maxAge: *influxInterval})
+		sink, err := newInfluxSink(registry)
+		if err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Pushing metrics to InfluxDB", "interval", *influxInterval)
+		go runPeriodically(*influxInterval, log.With(logger, "sink", "influx"), sink.push)
+	}
+
+	if *cloudwatchNamespace != "" {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(pushCollector{es: exporter, maxAge: *cloudwatchInterval})
+		sink, err := newCloudwatchSink(registry)
+		if err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Pushing metrics to CloudWatch", "namespace", *cloudwatchNamespace, "interval", *cloudwatchInterval)
+		go runPeriodically(*cloudwatchInterval, log.With(logger, "sink", "cloudwatch"), sink.push)
+	}
+
+	useTLS, err := tlsEnabled(*tlsCertFile, *tlsKeyFile, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Unable to load the TLS certificate and key", "cert_file", *tlsCertFile, "key_file", *tlsKeyFile, "error", err)
+		os.Exit(1)
+	}
 
-	level.Info(logger).Log("Google Project", *gcpProjectID)
 	level.Info(logger).Log("msg", "Listening", "address", *listenAddress)
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>GCP Quota Exporter</title></head>
-             <body>
-             <h1>GCP Quota Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
-             </body>
-             </html>`))
+	protect := func(handler http.Handler) http.Handler { return handler }
+	if *authUsername != "" || *authPassword != "" {
+		if *authUsername == "" || *authPassword == "" {
+			level.Error(logger).Log("msg", "Basic authentication needs both --web.auth-username and --web.auth-password-file")
+			os.Exit(1)
+		}
+		password, err := readPassword(*authPassword)
+		if err != nil {
+			level.Error(logger).Log("error", err)
+			os.Exit(1)
+		}
+		protect = func(handler http.Handler) http.Handler { return basicAuthHandler(handler, *authUsername, password) }
+	}
+
+	http.Handle(*metricsPath, protect(metricsHandler(exporter)))
+	// Probes of projects that aren't monitored share clients with the
+	// credentials of no project in particular, created on the first of them
+	// as the projects may all have their own.
+	probeClients := lazyClients(func() (googleClients, error) {
+		clients, err := newGoogleClients(logger, sharedCredentialsFile(*gcpCredentialsFiles))
+		if err != nil {
+			return googleClients{}, err
+		}
+		if *basePath != "" {
+			clients.compute.BasePath = *basePath
+		}
+		return clients, nil
 	})
-	err = http.ListenAndServe(*listenAddress, nil)
-	level.Error(logger).Log("error", err)
-	os.Exit(1)
+	http.Handle("/probe", protect(probeHandler(exporter, probeClients, logger)))
+	http.HandleFunc("/healthz", healthHandler(exporter.Health))
+	http.Handle("/quotas", protect(quotasHandler(exporter)))
+	if *enableLifecycle {
+		http.Handle("/-/pause", protect(lifecycleHandler(exporter.Pause, logger, "Scraping paused")))
+		http.Handle("/-/resume", protect(lifecycleHandler(exporter.Resume, logger, "Scraping resumed")))
+		http.Handle("/-/reload", protect(reloadHandler(exporter, logger)))
+	}
+	reloadOnSIGHUP(exporter, logger)
+	http.HandleFunc("/", landingHandler(exporter, *metricsPath, *rootFormat))
+
+	server := &http.Server{Addr: *listenAddress}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	shutdown := shutdownOnSignal(server, signals, *shutdownTimeout, logger)
+	if useTLS {
+		err = server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		level.Error(logger).Log("error", err)
+		os.Exit(1)
+	}
+	<-shutdown
 }
@@ -1,34 +1,1087 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	promlog "github.com/prometheus/common/promlog"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+func TestMain(m *testing.M) {
+	// The exporter is configured from the command line flags, so give them
+	// their default values.
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 func TestScrape(t *testing.T) {
+	if os.Getenv("GOOGLE_PROJECT_ID") == "" {
+		t.Skip("GOOGLE_PROJECT_ID isn't set, skipping the test against the Google API")
+	}
 	logger := promlog.New(&promlog.Config{})
 
 	// TestSuccessfulConnection
-	exporter, _ := NewExporter(os.Getenv("GOOGLE_PROJECT_ID"), logger)
-	projectUp, regionsUp := exporter.scrape()
+	exporter, _ := NewExporter(os.Getenv("GOOGLE_PROJECT_ID"), "", logger)
+	projectUp, regionsUp := exporter.scrape(context.Background())
 	if projectUp == nil {
 		t.Errorf("TestSuccessfulConnection: projectUp=0, expected=1")
 	}
 	if regionsUp == nil {
 		t.Errorf("TestSuccessfulConnection: regionsUp=0, expected=1")
 	}
+}
+
+func TestCollectReplayedQuotas(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	expected := `
+# HELP gcp_quota_limit quota limits for GCP components
+# TYPE gcp_quota_limit gauge
+gcp_quota_limit{metric="CPUS",project="test-project",region="europe-west1",source="compute"} 24
+gcp_quota_limit{metric="CPUS",project="test-project",region="us-east1",source="compute"} 24
+gcp_quota_limit{metric="CPUS_ALL_REGIONS",project="test-project",region="",source="compute"} 24
+gcp_quota_limit{metric="DISKS_TOTAL_GB",project="test-project",region="europe-west1",source="compute"} 4096
+gcp_quota_limit{metric="DISKS_TOTAL_GB",project="test-project",region="us-east1",source="compute"} 4096
+gcp_quota_limit{metric="FIREWALLS",project="test-project",region="",source="compute"} 100
+gcp_quota_limit{metric="IN_USE_ADDRESSES",project="test-project",region="europe-west1",source="compute"} 8
+gcp_quota_limit{metric="IN_USE_ADDRESSES",project="test-project",region="us-east1",source="compute"} 8
+gcp_quota_limit{metric="NETWORKS",project="test-project",region="",source="compute"} 5
+gcp_quota_limit{metric="SNAPSHOTS",project="test-project",region="",source="compute"} 1000
+# HELP gcp_quota_project_up Was the last scrape of the Google Project API successful.
+# TYPE gcp_quota_project_up gauge
+gcp_quota_project_up{project="test-project"} 1
+# HELP gcp_quota_regions_up Was the last scrape of the Google Regions API successful.
+# TYPE gcp_quota_regions_up gauge
+gcp_quota_regions_up{project="test-project"} 1
+# HELP gcp_quota_usage quota usage for GCP components
+# TYPE gcp_quota_usage gauge
+gcp_quota_usage{metric="CPUS",project="test-project",region="europe-west1",source="compute"} 4
+gcp_quota_usage{metric="CPUS",project="test-project",region="us-east1",source="compute"} 2
+gcp_quota_usage{metric="CPUS_ALL_REGIONS",project="test-project",region="",source="compute"} 6
+gcp_quota_usage{metric="DISKS_TOTAL_GB",project="test-project",region="europe-west1",source="compute"} 120
+gcp_quota_usage{metric="DISKS_TOTAL_GB",project="test-project",region="us-east1",source="compute"} 0
+gcp_quota_usage{metric="FIREWALLS",project="test-project",region="",source="compute"} 17
+gcp_quota_usage{metric="IN_USE_ADDRESSES",project="test-project",region="europe-west1",source="compute"} 1
+gcp_quota_usage{metric="IN_USE_ADDRESSES",project="test-project",region="us-east1",source="compute"} 0
+gcp_quota_usage{metric="NETWORKS",project="test-project",region="",source="compute"} 2
+gcp_quota_usage{metric="SNAPSHOTS",project="test-project",region="",source="compute"} 12
+`
+	names := []string{"gcp_quota_limit", "gcp_quota_usage", "gcp_quota_project_up", "gcp_quota_regions_up"}
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Errorf("TestCollectReplayedQuotas: %v", err)
+	}
+
+	// TestFailedConnection: without fixtures every call gets a 404.
+	exporter = newProjectReplayExporter(t, t.TempDir(), "missing")
+	expected = `
+# HELP gcp_quota_project_up Was the last scrape of the Google Project API successful.
+# TYPE gcp_quota_project_up gauge
+gcp_quota_project_up{project="missing"} 0
+# HELP gcp_quota_regions_up Was the last scrape of the Google Regions API successful.
+# TYPE gcp_quota_regions_up gauge
+gcp_quota_regions_up{project="missing"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), names...); err != nil {
+		t.Errorf("TestCollectReplayedQuotas: %v", err)
+	}
+}
+
+func TestDedupeQuotas(t *testing.T) {
+	quotas := []*compute.Quota{
+		{Metric: "CPUS", Limit: 24, Usage: 4},
+		{Metric: "DISKS_TOTAL_GB", Limit: 4096, Usage: 100},
+		{Metric: "CPUS", Limit: 48, Usage: 8},
+	}
+
+	merged, duplicates := dedupeQuotas(quotas, "last")
+	if duplicates != 1 || len(merged) != 2 {
+		t.Fatalf("TestDedupeQuotas(last): got %d quotas and %d duplicates, expected 2 and 1", len(merged), duplicates)
+	}
+	if merged[0].Metric != "CPUS" || merged[0].Limit != 48 || merged[0].Usage != 8 {
+		t.Errorf("TestDedupeQuotas(last): CPUS=%+v, expected limit=48 usage=8", merged[0])
+	}
+
+	merged, _ = dedupeQuotas(quotas, "sum")
+	if merged[0].Limit != 72 || merged[0].Usage != 12 {
+		t.Errorf("TestDedupeQuotas(sum): CPUS=%+v, expected limit=72 usage=12", merged[0])
+	}
+	if quotas[0].Limit != 24 {
+		t.Errorf("TestDedupeQuotas(sum): input quota was modified")
+	}
+}
+
+func TestDropEmptyRegion(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.paused = true
+	exporter.dropEmptyRegion = true
+	exporter.lastProject = &compute.Project{Quotas: []*compute.Quota{
+		{Metric: "CPUS", Limit: 24, Usage: 4},
+		{Metric: "NETWORKS", Limit: 5, Usage: 2},
+	}}
+	exporter.lastRegionList = &compute.RegionList{Items: []*compute.Region{
+		{Name: "europe-west1", Quotas: []*compute.Quota{{Metric: "CPUS", Limit: 24, Usage: 4}}},
+	}}
+
+	expected := `
+# HELP gcp_quota_limit quota limits for GCP components
+# TYPE gcp_quota_limit gauge
+gcp_quota_limit{metric="CPUS",project="test-project",region="europe-west1",source="compute"} 24
+gcp_quota_limit{metric="NETWORKS",project="test-project",region="",source="compute"} 5
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_limit"); err != nil {
+		t.Errorf("TestDropEmptyRegion: %v", err)
+	}
+
+	// Nothing is dropped when the regions couldn't be read.
+	exporter.lastRegionList = nil
+	if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != 2 {
+		t.Errorf("TestDropEmptyRegion: gcp_quota_limit series=%d without regions, expected=2", got)
+	}
+}
+
+func TestCollectDuplicates(t *testing.T) {
+	exporter := &Exporter{
+		project:           "test-project",
+		logger:            promlog.New(&promlog.Config{}),
+		limitDesc:         prometheus.NewDesc("gcp_quota_limit", "", quotaLabels, nil),
+		usageDesc:         prometheus.NewDesc("gcp_quota_usage", "", quotaLabels, nil),
+		utilizationDesc:   prometheus.NewDesc("gcp_quota_utilization_ratio", "", quotaLabels, nil),
+		paused:            true,
+		duplicateStrategy: "last",
+		duplicates:        prometheus.NewCounter(prometheus.CounterOpts{Name: "gcp_quota_duplicate_metrics_total"}),
+		sanityRejected:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "gcp_quota_sanity_rejected_total"}, []string{"metric"}),
+		scrapeErrors:      newScrapeErrors("test-project"),
+		lastProject: &compute.Project{Quotas: []*compute.Quota{
+			{Metric: "CPUS", Limit: 24, Usage: 4},
+			{Metric: "CPUS", Limit: 24, Usage: 6},
+		}},
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter)
+	before := testutil.ToFloat64(exporter.duplicates)
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("TestCollectDuplicates: gather failed: %v", err)
+	}
+	if got := testutil.ToFloat64(exporter.duplicates) - before; got != 1 {
+		t.Errorf("TestCollectDuplicates: gcp_quota_duplicate_metrics_total=%v, expected=1", got)
+	}
+}
+
+func TestStaleMarkers(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.staleMarkers = true
+	exporter.paused = true
+	exporter.lastProject = &compute.Project{Quotas: []*compute.Quota{
+		{Metric: "CPUS", Limit: 24, Usage: 4},
+		{Metric: "NETWORKS", Limit: 5, Usage: 2},
+	}}
+	testutil.CollectAndCount(exporter)
+
+	exporter.lastProject.Quotas = exporter.lastProject.Quotas[:1]
+	ch := make(chan prometheus.Metric, 100)
+	exporter.Collect(ch)
+	close(ch)
+
+	stale := 0
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.GetGauge() != nil && math.Float64bits(m.GetGauge().GetValue()) == staleNaN {
+			stale++
+		}
+	}
+	if stale != 3 {
+		t.Errorf("TestStaleMarkers: stale markers=%d, expected=3 for the NETWORKS limit, usage and utilization", stale)
+	}
+}
+
+func TestMetricsHandlerStaleMarkers(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.staleMarkers = true
+	exporter.paused = true
+	quotas := []*compute.Quota{
+		{Metric: "CPUS", Limit: 24, Usage: 4},
+		{Metric: "NETWORKS", Limit: 5, Usage: 2},
+	}
+	// scrape serves the quotas and returns the response to accept.
+	scrape := func(quotas []*compute.Quota, accept string) *httptest.ResponseRecorder {
+		exporter.lastProject = &compute.Project{Quotas: quotas}
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept", accept)
+		recorder := httptest.NewRecorder()
+		metricsHandler(exporters{exporter})(recorder, request)
+		return recorder
+	}
+
+	// The protobuf format carries the stale markers of NETWORKS.
+	const protobuf = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+	scrape(quotas, protobuf)
+	recorder := scrape(quotas[:1], protobuf)
+	decoder := expfmt.NewDecoder(recorder.Body, expfmt.ResponseFormat(recorder.Header()))
+	stale := 0
+	for {
+		var family dto.MetricFamily
+		if err := decoder.Decode(&family); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range family.GetMetric() {
+			if m.GetGauge() != nil && math.Float64bits(m.GetGauge().GetValue()) == 0x7ff0000000000002 {
+				stale++
+			}
+		}
+	}
+	if stale != 3 {
+		t.Errorf("TestMetricsHandlerStaleMarkers: stale markers=%d in the protobuf response, expected=3", stale)
+	}
+
+	// The text format would turn them into plain NaN samples.
+	scrape(quotas, "text/plain")
+	recorder = scrape(quotas[:1], "text/plain")
+	if strings.Contains(recorder.Body.String(), "NaN") {
+		t.Errorf("TestMetricsHandlerStaleMarkers: text response has NaN samples:\n%s", recorder.Body)
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.paused = true
+	exporter.lastProject = &compute.Project{Quotas: []*compute.Quota{
+		{Metric: "CPUS", Limit: 24, Usage: 6},
+		{Metric: "NETWORKS", Limit: 0, Usage: 0},
+		{Metric: "ROUTES", Limit: -1, Usage: 3},
+	}}
+
+	// A limit of 0, or of -1 meaning unlimited, gives 0 rather than NaN.
+	expected := `
+# HELP gcp_quota_utilization_ratio quota usage divided by the limit, 0 when the limit is 0 or unlimited
+# TYPE gcp_quota_utilization_ratio gauge
+gcp_quota_utilization_ratio{metric="CPUS",project="test-project",region="",source="compute"} 0.25
+gcp_quota_utilization_ratio{metric="NETWORKS",project="test-project",region="",source="compute"} 0
+gcp_quota_utilization_ratio{metric="ROUTES",project="test-project",region="",source="compute"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_utilization_ratio"); err != nil {
+		t.Errorf("TestUtilization: %v", err)
+	}
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	server.Start()
+	defer server.Close()
+
+	signals := make(chan os.Signal, 1)
+	done := shutdownOnSignal(server.Config, signals, time.Second, promlog.New(&promlog.Config{}))
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+	signals <- syscall.SIGTERM
+
+	if err := <-result; err != nil {
+		t.Errorf("TestShutdownOnSignal: in-flight request failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("TestShutdownOnSignal: shutdown didn't complete")
+	}
+	if _, err := http.Get(server.URL); err == nil {
+		t.Errorf("TestShutdownOnSignal: request after shutdown succeeded, expected the listener to be closed")
+	}
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	handler := basicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), "prometheus", "secret")
+
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+		auth     bool
+		expected int
+	}{
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+		{"wrong username", "admin", "secret", true, http.StatusUnauthorized},
+		{"wrong password", "prometheus", "guess", true, http.StatusUnauthorized},
+		{"valid", "prometheus", "secret", true, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.auth {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.expected {
+			t.Errorf("TestBasicAuthHandler(%s): status=%d, expected=%d", tc.name, rec.Code, tc.expected)
+		}
+		if tc.expected == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("TestBasicAuthHandler(%s): missing WWW-Authenticate header", tc.name)
+		}
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	password, err := readPassword(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "secret" {
+		t.Errorf("TestReadPassword: password=%q, expected=%q", password, "secret")
+	}
+
+	if _, err := readPassword(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("TestReadPassword: expected an error for a missing file")
+	}
+}
+
+// writeTLSFiles writes a self-signed certificate and a private key to dir,
+// the key of another certificate when mismatched is set.
+func writeTLSFiles(t *testing.T, dir string, mismatched bool) (certFile, keyFile string) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key := newKey()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatched {
+		key = newKey()
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyBytes},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestTLSEnabled(t *testing.T) {
+	certFile, keyFile := writeTLSFiles(t, t.TempDir(), false)
+	mismatchedCert, mismatchedKey := writeTLSFiles(t, t.TempDir(), true)
+
+	for _, tc := range []struct {
+		name     string
+		certFile string
+		keyFile  string
+		enabled  bool
+		err      bool
+		warning  bool
+	}{
+		{"disabled", "", "", false, false, false},
+		{"valid", certFile, keyFile, true, false, false},
+		{"mismatched key", mismatchedCert, mismatchedKey, false, true, false},
+		{"cert only", certFile, "", false, false, true},
+		{"key only", "", keyFile, false, false, true},
+	} {
+		var buf bytes.Buffer
+		enabled, err := tlsEnabled(tc.certFile, tc.keyFile, log.NewLogfmtLogger(&buf))
+		if enabled != tc.enabled || (err != nil) != tc.err {
+			t.Errorf("TestTLSEnabled(%s): enabled=%v err=%v, expected enabled=%v error=%v", tc.name, enabled, err, tc.enabled, tc.err)
+		}
+		if warning := strings.Contains(buf.String(), "level=warn"); warning != tc.warning {
+			t.Errorf("TestTLSEnabled(%s): warning=%v, expected=%v: %s", tc.name, warning, tc.warning, buf.String())
+		}
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := newExporter(service, "test-project", promlog.New(&promlog.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.scrapeTimeout = 50 * time.Millisecond
+	before := testutil.ToFloat64(exporter.scrapeErrors.WithLabelValues("region", "timeout"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		project, regionList := exporter.scrape(context.Background())
+		if project != nil || regionList != nil {
+			t.Errorf("TestScrapeTimeout: project=%v regionList=%v, expected both to time out", project, regionList)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestScrapeTimeout: scrape is still hanging past the scrape timeout")
+	}
+	if got := testutil.ToFloat64(exporter.scrapeErrors.WithLabelValues("region", "timeout")) - before; got != 1 {
+		t.Errorf("TestScrapeTimeout: gcp_quota_scrape_errors_total{phase=\"region\",reason=\"timeout\"}=%v, expected=1", got)
+	}
+}
+
+func TestMetricsHandlerScrapeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	service, err := compute.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/compute/v1/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := newExporter(service, "test-project", promlog.New(&promlog.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	exporter.logger = log.NewLogfmtLogger(&logs)
+
+	// --gcp.scrape-timeout is 30s, the header bounds the scrape to 0.5s.
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "1")
+	recorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		metricsHandler(exporters{exporter})(recorder, request)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestMetricsHandlerScrapeTimeout: scrape is still hanging past the Prometheus scrape timeout")
+	}
+
+	for _, expected := range []string{
+		`gcp_quota_project_up{project="test-project"} 0`,
+		`gcp_quota_scrape_error{project="test-project",reason="timeout"} 1`,
+		`gcp_quota_scrape_timed_out{project="test-project"} 1`,
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("TestMetricsHandlerScrapeTimeout: body doesn't contain %s:\n%s", expected, recorder.Body)
+		}
+	}
+	if !strings.Contains(logs.String(), `msg="Scrape exceeded the Prometheus scrape timeout, returning partial results"`) {
+		t.Errorf("TestMetricsHandlerScrapeTimeout: the header deadline wasn't logged: %s", logs.String())
+	}
+
+	// --gcp.max-scrape-duration is reported as such.
+	logs.Reset()
+	exporter.maxScrapeDuration = 100 * time.Millisecond
+	recorder = httptest.NewRecorder()
+	metricsHandler(exporters{exporter})(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `gcp_quota_scrape_timed_out{project="test-project"} 1`) {
+		t.Errorf("TestMetricsHandlerScrapeTimeout: body doesn't report the timeout:\n%s", recorder.Body)
+	}
+	if !strings.Contains(logs.String(), `msg="Scrape exceeded the maximum duration, returning partial results" max_scrape_duration=100ms`) {
+		t.Errorf("TestMetricsHandlerScrapeTimeout: the maximum duration wasn't logged: %s", logs.String())
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	defer func(enabled bool) { *webOpenMetrics = enabled }(*webOpenMetrics)
+	for _, enabled := range []bool{false, true} {
+		*webOpenMetrics = enabled
+		exporter := newProjectReplayExporter(t, t.TempDir(), "missing")
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		request.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		recorder := httptest.NewRecorder()
+		metricsHandler(exporters{exporter})(recorder, request)
+
+		contentType := recorder.Header().Get("Content-Type")
+		if openMetrics := strings.HasPrefix(contentType, "application/openmetrics-text"); openMetrics != enabled {
+			t.Errorf("TestMetricsHandlerOpenMetrics: enabled=%t, Content-Type=%s", enabled, contentType)
+		}
+		if !enabled {
+			continue
+		}
+		// OpenMetrics counters are typed without their _total suffix and
+		// values are always floats.
+		for _, expected := range []string{
+			"# TYPE gcp_quota_scrape_errors counter",
+			`gcp_quota_scrape_errors_total{phase="project",project="missing",reason="not_found"} 1.0`,
+			"# EOF",
+		} {
+			if !strings.Contains(recorder.Body.String(), expected) {
+				t.Errorf("TestMetricsHandlerOpenMetrics: body doesn't contain %s:\n%s", expected, recorder.Body)
+			}
+		}
+	}
+}
+
+func TestConfigInfo(t *testing.T) {
+	es := exporters{
+		newReplayExporter(t, "testdata/fixtures"),
+		newProjectReplayExporter(t, t.TempDir(), "missing"),
+	}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(es)(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	expected := `gcp_quota_config_info{api_version="v1",cache_ttl="0s",concurrency="4",config_file="false",http_timeout="10s",max_scrape_duration="0s",projects="2",scrape_interval="0s",scrape_timeout="30s",source="compute"} 1`
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Errorf("TestConfigInfo: body doesn't contain %s:\n%s", expected, recorder.Body)
+	}
+}
+
+func TestPrometheusScrapeTimeout(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"":     0,
+		"abc":  0,
+		"-1":   0,
+		"10":   9500 * time.Millisecond,
+		"0.25": 250 * time.Millisecond,
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if header != "" {
+			request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", header)
+		}
+		timeout, ok := prometheusScrapeTimeout(request)
+		if timeout != expected || ok != (expected != 0) {
+			t.Errorf("TestPrometheusScrapeTimeout: header=%q timeout=%v ok=%v, expected=%v", header, timeout, ok, expected)
+		}
+	}
+}
+
+func TestBuildInfoName(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newBuildInfoGauge())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "gcp_quota_exporter_build_info" {
+		t.Fatalf("TestBuildInfoName: families=%v, expected gcp_quota_exporter_build_info", families)
+	}
+
+	var labels []string
+	for _, label := range families[0].GetMetric()[0].GetLabel() {
+		// The VCS labels are only there when built from a git checkout.
+		if !strings.HasPrefix(label.GetName(), "vcs_") {
+			labels = append(labels, label.GetName())
+		}
+	}
+	if got := strings.Join(labels, ","); got != "branch,goversion,revision,version" {
+		t.Errorf("TestBuildInfoName: labels=%s, expected=branch,goversion,revision,version", got)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected string
+	}{
+		{&googleapi.Error{Code: http.StatusUnauthorized}, "auth"},
+		{&googleapi.Error{Code: http.StatusForbidden}, "auth"},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}}, "auth"},
+		{&googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, "rate_limited"},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, "rate_limited"},
+		{&googleapi.Error{Code: http.StatusNotFound}, "not_found"},
+		{fmt.Errorf("Get projects: %w", context.DeadlineExceeded), "timeout"},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, "unknown"},
+		{errors.New("unexpected EOF"), "unknown"},
+	} {
+		if got := errorClass(test.err); got != test.expected {
+			t.Errorf("TestErrorClass: err=%v class=%s, expected=%s", test.err, got, test.expected)
+		}
+	}
+}
+
+func TestScopeLabel(t *testing.T) {
+	*webScopeLabel = true
+	defer func() { *webScopeLabel = false }()
+	exporter := newReplayExporter(t, "testdata/fixtures")
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := make(map[string]int)
+	for _, family := range families {
+		if family.GetName() != "gcp_quota_limit" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["scope"] != quotaScope(labels["region"]) {
+				t.Errorf("TestScopeLabel: scope=%q for region=%q", labels["scope"], labels["region"])
+			}
+			scopes[labels["scope"]]++
+		}
+	}
+	if scopes["project"] == 0 || scopes["region"] == 0 {
+		t.Errorf("TestScopeLabel: scopes=%v, expected project and region quotas", scopes)
+	}
+
+	for region, expected := range map[string]string{
+		"":              "project",
+		"europe-west1":  "region",
+		"us-central1-a": "zone",
+	} {
+		if got := quotaScope(region); got != expected {
+			t.Errorf("TestScopeLabel: quotaScope(%q)=%s, expected=%s", region, got, expected)
+		}
+	}
+}
+
+func TestProjectNumberLabel(t *testing.T) {
+	*gcpProjectNumberLabel = true
+	defer func() { *gcpProjectNumberLabel = false }()
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.metricFilter, _ = filterConfig{Include: []string{"CPUS"}}.compile()
+
+	expected := `
+# HELP gcp_quota_limit quota limits for GCP components
+# TYPE gcp_quota_limit gauge
+gcp_quota_limit{metric="CPUS",project="test-project",project_number="1234567890123456789",region="europe-west1",source="compute"} 24
+gcp_quota_limit{metric="CPUS",project="test-project",project_number="1234567890123456789",region="us-east1",source="compute"} 24
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_limit"); err != nil {
+		t.Errorf("TestProjectNumberLabel: %v", err)
+	}
+}
+
+func TestMinUtilization(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.minUtilization = 0.5
+	exporter.alwaysInclude = regexp.MustCompile("^CPUS$")
+	for _, test := range []struct {
+		quota    compute.Quota
+		expected bool
+	}{
+		{compute.Quota{Metric: "NETWORKS", Limit: 10, Usage: 2}, false},
+		{compute.Quota{Metric: "NETWORKS", Limit: 10, Usage: 5}, true},
+		{compute.Quota{Metric: "NETWORKS", Limit: 0, Usage: 0}, true},
+		{compute.Quota{Metric: "NETWORKS", Limit: -1, Usage: 2}, true},
+		{compute.Quota{Metric: "CPUS", Limit: 24, Usage: 1}, true},
+	} {
+		if got := exporter.includeQuota(&test.quota); got != test.expected {
+			t.Errorf("TestMinUtilization: quota=%+v included=%v, expected=%v", test.quota, got, test.expected)
+		}
+	}
+
+	*gcpMinUtilization = 1.5
+	defer func() { *gcpMinUtilization = 0 }()
+	if _, err := newExporter(exporter.service, "test-project", promlog.New(&promlog.Config{})); err == nil {
+		t.Error("TestMinUtilization: --gcp.min-utilization=1.5 accepted")
+	}
+}
+
+func TestMinLimit(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.minLimit = 10
+	exporter.alwaysInclude = regexp.MustCompile("^CPUS$")
+	filter, err := newNameFilter([]string{"NETWORKS", "FIREWALLS"}, []string{"FIREWALLS", "CPUS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.metricFilter = filter
+	for _, test := range []struct {
+		quota    compute.Quota
+		expected bool
+	}{
+		{compute.Quota{Metric: "NETWORKS", Limit: 5}, false},
+		{compute.Quota{Metric: "NETWORKS", Limit: 10}, true},
+		{compute.Quota{Metric: "FIREWALLS", Limit: 100}, false}, // excluded
+		{compute.Quota{Metric: "ROUTES", Limit: 100}, false},    // not included
+		{compute.Quota{Metric: "CPUS", Limit: 1}, true},         // always included despite the limit and the exclude filter
+	} {
+		if got := exporter.includeQuota(&test.quota); got != test.expected {
+			t.Errorf("TestMinLimit: quota=%+v included=%v, expected=%v", test.quota, got, test.expected)
+		}
+	}
+}
+
+func TestMetricPrefix(t *testing.T) {
+	setMetricPrefix("acme_gcp_quota")
+	defer setMetricPrefix(defaultMetricPrefix)
+
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.resourceLabelKeys = []string{"team"}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter, apiRequests)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labeled := false
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "acme_gcp_quota_") {
+			t.Errorf("TestMetricPrefix: %s doesn't start with the prefix", family.GetName())
+		}
+		labeled = labeled || family.GetName() == "acme_gcp_quota_labeled_resource_count"
+	}
+	if !labeled {
+		t.Error("TestMetricPrefix: acme_gcp_quota_labeled_resource_count not gathered")
+	}
+}
+
+func TestValidateMetricPrefix(t *testing.T) {
+	for prefix, valid := range map[string]bool{
+		"gcp_quota":      true,
+		"acme:gcp_quota": true,
+		"_acme":          true,
+		"":               false,
+		"0acme":          false,
+		"acme-gcp":       false,
+		"acme_":          false,
+	} {
+		if err := validateMetricPrefix(prefix); (err == nil) != valid {
+			t.Errorf("TestValidateMetricPrefix: prefix=%q err=%v, expected valid=%v", prefix, err, valid)
+		}
+	}
+}
 
-	// TestFailedConnection
-	// Set the project name to "503" since the Google Compute API will append this to the end of the BasePath
-	exporter, _ = NewExporter("503", logger)
-	exporter.service.BasePath = "http://httpstat.us/"
-	projectUp, regionsUp = exporter.scrape()
-	if projectUp != nil {
-		t.Errorf("TestFailedConnection: projectUp=1, expected=0")
+func TestUnlimitedQuotas(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.paused = true
+	exporter.lastProject = &compute.Project{Quotas: []*compute.Quota{
+		{Metric: "CPUS", Limit: 24, Usage: 4},
+		{Metric: "NETWORKS", Limit: -1, Usage: 2},
+		{Metric: "FIREWALLS", Limit: 9223372036854775807, Usage: 7},
+	}}
+
+	expected := `
+# HELP gcp_quota_unlimited The quota has no effective limit, its limit is a sentinel value.
+# TYPE gcp_quota_unlimited gauge
+gcp_quota_unlimited{metric="FIREWALLS",project="test-project",region=""} 1
+gcp_quota_unlimited{metric="NETWORKS",project="test-project",region=""} 1
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_unlimited"); err != nil {
+		t.Errorf("TestUnlimitedQuotas: %v", err)
+	}
+}
+
+func TestQuotasHandler(t *testing.T) {
+	exporter := newReplayExporter(t, "testdata/fixtures")
+	exporter.paused = true
+	exporter.lastProject = &compute.Project{Quotas: []*compute.Quota{
+		{Metric: "NETWORKS", Limit: 5, Usage: 2},
+		{Metric: "CPUS_ALL_REGIONS", Limit: 32, Usage: 4},
+	}}
+	exporter.lastRegionList = &compute.RegionList{Items: []*compute.Region{
+		{Name: "europe-west1", Quotas: []*compute.Quota{{Metric: "CPUS"}, {Metric: "DISKS_TOTAL_GB"}}},
+		{Name: "us-east1", Quotas: []*compute.Quota{{Metric: "CPUS"}}},
+	}}
+
+	recorder := httptest.NewRecorder()
+	quotasHandler(exporters{exporter})(recorder, httptest.NewRequest(http.MethodGet, "/quotas", nil))
+
+	expected := `{"test-project":{"project":["CPUS_ALL_REGIONS","NETWORKS"],"region":["CPUS","DISKS_TOTAL_GB"]}}`
+	if got := strings.TrimSpace(recorder.Body.String()); got != expected {
+		t.Errorf("TestQuotasHandler: body=%s, expected=%s", got, expected)
+	}
+}
+
+func TestLandingHandler(t *testing.T) {
+	up := newProjectReplayExporter(t, "testdata/fixtures", "up-<project>")
+	up.scraped = true
+	down := newProjectReplayExporter(t, "testdata/fixtures", "down-project")
+
+	for format, expected := range map[string][]string{
+		"html": {`<a href="/metrics">`, "<td>up-&lt;project&gt;</td><td>succeeded</td>", "<td>down-project</td><td>failed</td>"},
+		"text": {"Metrics: /metrics\n", "Project: up-<project> (last scrape succeeded)\n", "Project: down-project (last scrape failed)\n"},
+	} {
+		recorder := httptest.NewRecorder()
+		landingHandler(exporters{up, down}, "/metrics", format)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		for _, want := range expected {
+			if !strings.Contains(recorder.Body.String(), want) {
+				t.Errorf("TestLandingHandler(%s): body doesn't contain %q:\n%s", format, want, recorder.Body)
+			}
+		}
+	}
+}
+
+func TestScrapeConcurrentCalls(t *testing.T) {
+	// Both calls take latency, so sequential calls would take twice as long
+	// as concurrent ones.
+	const latency = 200 * time.Millisecond
+	handler := replayHandler(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	exporter := newServerExporter(t, server, "test-project")
+	start := time.Now()
+	project, regionList := exporter.scrape(context.Background())
+	elapsed := time.Since(start)
+	if project == nil || regionList == nil {
+		t.Fatalf("TestScrapeConcurrentCalls: project=%v regionList=%v, expected both", project, regionList)
+	}
+	t.Logf("scrape took %v with %v per call, %v when sequential", elapsed, latency, 2*latency)
+	if elapsed >= 2*latency {
+		t.Errorf("TestScrapeConcurrentCalls: scrape took %v, expected less than %v", elapsed, 2*latency)
+	}
+}
+
+func TestGetProjectIdFromMetadataTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { *gcpMetadataTimeout = timeout }(*gcpMetadataTimeout)
+	*gcpMetadataTimeout = 100 * time.Millisecond
+
+	// The metadata server accepts connections but never answers.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	start := time.Now()
+	_, err := GetProjectIdFromMetadata()
+	if err == nil {
+		t.Fatal("TestGetProjectIdFromMetadataTimeout: expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TestGetProjectIdFromMetadataTimeout: took %v, expected to give up after the metadata timeout", elapsed)
+	}
+	if !strings.Contains(err.Error(), "--gcp.project_id") {
+		t.Errorf("TestGetProjectIdFromMetadataTimeout: error doesn't mention --gcp.project_id: %v", err)
+	}
+}
+
+func TestCollectSingleFlight(t *testing.T) {
+	// The first Projects.Get blocks until the other collections are waiting
+	// for its scrape.
+	var projectCalls int32
+	called := make(chan struct{})
+	release := make(chan struct{})
+	handler := replayHandler(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/compute/v1/projects/test-project" && atomic.AddInt32(&projectCalls, 1) == 1 {
+			close(called)
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	exporter := newServerExporter(t, server, "test-project")
+
+	const collections = 5
+	counts := make(chan int, collections)
+	// uncheckedCollector skips the collection made by Describe.
+	collect := func() { counts <- testutil.CollectAndCount(uncheckedCollector{exporter}, "gcp_quota_limit") }
+	go collect()
+	<-called
+	for i := 1; i < collections; i++ {
+		go collect()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < collections; i++ {
+		if count := <-counts; count != 10 {
+			t.Errorf("TestCollectSingleFlight: %d gcp_quota_limit series, expected 10", count)
+		}
+	}
+	if calls := atomic.LoadInt32(&projectCalls); calls != 1 {
+		t.Errorf("TestCollectSingleFlight: %d Projects.Get calls, expected 1", calls)
+	}
+}
+
+func TestCollectSharedContext(t *testing.T) {
+	// Projects.Get answers after the collection that started the scrape has
+	// been canceled, e.g. by a Prometheus replica that went away.
+	called := make(chan struct{})
+	var projectCalls int32
+	handler := replayHandler(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/compute/v1/projects/test-project" && atomic.AddInt32(&projectCalls, 1) == 1 {
+			close(called)
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	exporter := newServerExporter(t, server, "test-project")
+
+	first, cancelFirst := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFirst()
+	second, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts := make(chan int, 2)
+	collect := func(ctx context.Context) {
+		counts <- testutil.CollectAndCount(requestCollector{es: exporters{exporter}, ctx: ctx}, "gcp_quota_limit")
+	}
+	go collect(first)
+	<-called
+	go collect(second)
+	cancelFirst()
+
+	// The shared scrape outlives the context of the collection that
+	// started it.
+	for i := 0; i < 2; i++ {
+		if count := <-counts; count != 10 {
+			t.Errorf("TestCollectSharedContext: %d gcp_quota_limit series, expected 10", count)
+		}
+	}
+}
+
+func TestScrapeInProgressSeconds(t *testing.T) {
+	// Projects.Get blocks until the gauge has been read during the scrape.
+	called := make(chan struct{})
+	release := make(chan struct{})
+	handler := replayHandler(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/compute/v1/projects/test-project" {
+			close(called)
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	exporter := newServerExporter(t, server, "test-project")
+
+	if seconds := exporter.ScrapeInProgressSeconds(); seconds != 0 {
+		t.Errorf("TestScrapeInProgressSeconds: %v before the scrape, expected 0", seconds)
+	}
+	done := make(chan struct{})
+	go func() {
+		testutil.CollectAndCount(uncheckedCollector{exporter})
+		close(done)
+	}()
+	<-called
+	time.Sleep(10 * time.Millisecond)
+	if seconds := exporter.ScrapeInProgressSeconds(); seconds <= 0 {
+		t.Errorf("TestScrapeInProgressSeconds: %v during the scrape, expected > 0", seconds)
+	}
+	close(release)
+	<-done
+	if seconds := exporter.ScrapeInProgressSeconds(); seconds != 0 {
+		t.Errorf("TestScrapeInProgressSeconds: %v after the scrape, expected 0", seconds)
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	defer func(version string) { *gcpAPIVersion = version }(*gcpAPIVersion)
+	*gcpAPIVersion = "beta"
+
+	// The calls sent to compute.googleapis.com are replayed by the server.
+	server := newReplayServer(t, "testdata/fixtures")
+	var paths []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		req.URL.Scheme, req.URL.Host = "http", server.Listener.Addr().String()
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	service, err := newComputeClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := newExporter(service, "test-project", promlog.New(&promlog.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := testutil.CollectAndCount(uncheckedCollector{exporter}, "gcp_quota_limit"); got != 10 {
+		t.Errorf("TestAPIVersion: %d gcp_quota_limit series, expected 10", got)
+	}
+	if len(paths) == 0 {
+		t.Fatal("TestAPIVersion: no Compute API calls")
 	}
-	if regionsUp != nil {
-		t.Errorf("TestFailedConnection: regionsUp=1, expected=0")
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/compute/beta/projects/test-project") {
+			t.Errorf("TestAPIVersion: call to %s, expected /compute/beta/projects/test-project", path)
+		}
 	}
 }
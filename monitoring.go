@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// sourceMonitoring is the source label value of quotas read from the Cloud
+// Monitoring API.
+const sourceMonitoring = "monitoring"
+
+// globalLocation is the location of the project-wide quotas in Cloud Monitoring.
+const globalLocation = "global"
+
+const (
+	monitoringUsageMetric = "serviceruntime.googleapis.com/quota/allocation/usage"
+	monitoringLimitMetric = "serviceruntime.googleapis.com/quota/limit"
+)
+
+var (
+	gcpSource = kingpin.Flag(
+		"gcp.source", "API the quotas are read from: compute for the Compute Engine quotas, or monitoring for the quota metrics of every Google service published to Cloud Monitoring. ($GCP_EXPORTER_SOURCE)",
+	).Envar("GCP_EXPORTER_SOURCE").Default(sourceCompute).Enum(sourceCompute, sourceMonitoring)
+
+	gcpMonitoringLookback = kingpin.Flag(
+		"gcp.monitoring-lookback", "How far back the latest point of the Cloud Monitoring quota time series is looked for, with --gcp.source=monitoring.",
+	).Default("25h").Duration()
+)
+
+// newMonitoringService returns an authenticated Cloud Monitoring API client.
+func newMonitoringService(logger log.Logger, credentialsFile string) (*monitoring.Service, error) {
+	googleClient, err := newGoogleClient(logger, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	monitoringService, err := monitoring.NewService(context.Background(), option.WithHTTPClient(googleClient))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Monitoring service: %v", err)
+	}
+	return monitoringService, nil
+}
+
+// scrapeMonitoring reads the latest quota usage and limits from Cloud
+// Monitoring. They're returned the way the Compute API returns them, the
+// global quotas in the project and the others in the region named after their
+// location, so that they're exported and filtered like Compute quotas. Both
+// phases report the duration of the Monitoring calls.
+func (e *Exporter) scrapeMonitoring(ctx context.Context) (*compute.Project, *compute.RegionList) {
+	var usage, limits []*monitoring.TimeSeries
+	start := time.Now()
+	err := e.retries.retry(ctx, e.logger, "timeSeries.list", func() (err error) {
+		callCtx, cancel := e.callContext(ctx)
+		defer cancel()
+		if usage, err = e.listTimeSeries(callCtx, monitoringUsageMetric); err != nil {
+			return err
+		}
+		limits, err = e.listTimeSeries(callCtx, monitoringLimitMetric)
+		return err
+	})
+	outcome := scrapeOutcome{projectDuration: time.Since(start)}
+	outcome.regionDuration = outcome.projectDuration
+	if err != nil {
+		reason := errorReason(err)
+		level.Error(e.logger).Log("msg", "Failure when querying Cloud Monitoring quotas", "phase", "monitoring", "reason", reason, "error", err)
+		e.scrapeErrors.WithLabelValues("monitoring", reason).Inc()
+		outcome.failures = []string{"timeSeries.list: " + err.Error()}
+		outcome.errorClass = errorClass(err)
+		e.recordOutcome(outcome)
+		return nil, nil
+	}
+
+	e.recordOutcome(outcome)
+	return monitoringQuotas(usage, limits)
+}
+
+// listTimeSeries returns the consumer_quota time series of metricType written
+// during the last --gcp.monitoring-lookback.
+func (e *Exporter) listTimeSeries(ctx context.Context, metricType string) ([]*monitoring.TimeSeries, error) {
+	end := time.Now()
+	var series []*monitoring.TimeSeries
+	err := e.monitoring.Projects.TimeSeries.List("projects/"+e.project).
+		Filter(fmt.Sprintf(`metric.type = %q AND resource.type = "consumer_quota"`, metricType)).
+		IntervalStartTime(end.Add(-e.monitoringLookback).Format(time.RFC3339)).
+		IntervalEndTime(end.Format(time.RFC3339)).
+		Pages(ctx, func(page *monitoring.ListTimeSeriesResponse) error {
+			series = append(series, page.TimeSeries...)
+			return nil
+		})
+	return series, err
+}
+
+// monitoringQuotas converts the latest points of the usage and limit time
+// series to Compute quotas named after the quota_metric label. Quotas without
+// a limit are skipped, those without usage have none allocated. When a quota
+// has several limits, e.g. per limit_name, the lowest one applies; a negative
+// limit, meaning unlimited, only applies when there's no other.
+func monitoringQuotas(usage, limits []*monitoring.TimeSeries) (*compute.Project, *compute.RegionList) {
+	type quotaKey struct{ location, metric string }
+	quotas := make(map[quotaKey]*compute.Quota)
+	for _, series := range limits {
+		limit, ok := latestValue(series)
+		if !ok {
+			continue
+		}
+		key := quotaKey{series.Resource.Labels["location"], series.Metric.Labels["quota_metric"]}
+		if quota, ok := quotas[key]; !ok || quota.Limit < 0 || (limit >= 0 && limit < quota.Limit) {
+			quotas[key] = &compute.Quota{Metric: key.metric, Limit: limit}
+		}
+	}
+	for _, series := range usage {
+		value, ok := latestValue(series)
+		if !ok {
+			continue
+		}
+		key := quotaKey{series.Resource.Labels["location"], series.Metric.Labels["quota_metric"]}
+		if quota, ok := quotas[key]; ok {
+			quota.Usage += value
+		}
+	}
+
+	project := &compute.Project{}
+	regions := make(map[string]*compute.Region)
+	for key, quota := range quotas {
+		if key.location == globalLocation {
+			project.Quotas = append(project.Quotas, quota)
+			continue
+		}
+		region, ok := regions[key.location]
+		if !ok {
+			region = &compute.Region{Name: key.location, Status: "UP"}
+			regions[key.location] = region
+		}
+		region.Quotas = append(region.Quotas, quota)
+	}
+
+	regionList := &compute.RegionList{}
+	for _, region := range regions {
+		sortQuotas(region.Quotas)
+		regionList.Items = append(regionList.Items, region)
+	}
+	sortQuotas(project.Quotas)
+	sort.Slice(regionList.Items, func(i, j int) bool { return regionList.Items[i].Name < regionList.Items[j].Name })
+	return project, regionList
+}
+
+// latestValue returns the value of the most recent point of series. The
+// Monitoring API returns the points newest first.
+func latestValue(series *monitoring.TimeSeries) (float64, bool) {
+	if len(series.Points) == 0 || series.Points[0].Value == nil {
+		return 0, false
+	}
+	value := series.Points[0].Value
+	switch {
+	case value.Int64Value != nil:
+		return float64(*value.Int64Value), true
+	case value.DoubleValue != nil:
+		return *value.DoubleValue, true
+	default:
+		return 0, false
+	}
+}
+
+func sortQuotas(quotas []*compute.Quota) {
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Metric < quotas[j].Metric })
+}
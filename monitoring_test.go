@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+// monitoringSeries is a ListTimeSeries response with one consumer_quota time
+// series per location and quota metric, newest point first.
+const monitoringSeries = `{"timeSeries": [%s]}`
+
+func monitoringPoint(location, metric, value string) string {
+	return fmt.Sprintf(`{
+		"metric": {"type": "m", "labels": {"quota_metric": %q}},
+		"resource": {"type": "consumer_quota", "labels": {"location": %q}},
+		"points": [{"value": {"int64Value": %q}}, {"value": {"int64Value": "1"}}]
+	}`, metric, location, value)
+}
+
+func TestScrapeMonitoring(t *testing.T) {
+	var filters []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/projects/test-project/timeSeries" {
+			t.Errorf("TestScrapeMonitoring: unexpected path %s", r.URL.Path)
+		}
+		filter := r.URL.Query().Get("filter")
+		filters = append(filters, filter)
+
+		var series []string
+		if strings.Contains(filter, monitoringLimitMetric) {
+			series = []string{
+				monitoringPoint("global", "compute.googleapis.com/networks", "15"),
+				monitoringPoint("global", "compute.googleapis.com/networks", "-1"),
+				monitoringPoint("europe-west1", "compute.googleapis.com/cpus", "-1"),
+				monitoringPoint("europe-west1", "compute.googleapis.com/cpus", "24"),
+				monitoringPoint("europe-west1", "compute.googleapis.com/cpus", "20"),
+				monitoringPoint("europe-west1", "compute.googleapis.com/firewalls", "-1"),
+			}
+		} else {
+			series = []string{
+				monitoringPoint("global", "compute.googleapis.com/networks", "3"),
+				monitoringPoint("europe-west1", "compute.googleapis.com/cpus", "8"),
+				monitoringPoint("europe-west1", "compute.googleapis.com/disks", "5"),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, monitoringSeries, strings.Join(series, ","))
+	}))
+	defer server.Close()
+
+	exporter := newReplayExporter(t, t.TempDir())
+	service, err := monitoring.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.monitoring, exporter.source = service, sourceMonitoring
+
+	// The lowest of the finite cpus and networks limits applies, firewalls
+	// only have an unlimited one, and the disks usage, which has no limit, is
+	// skipped.
+	expected := `
+# HELP gcp_quota_limit quota limits for GCP components
+# TYPE gcp_quota_limit gauge
+gcp_quota_limit{metric="compute.googleapis.com/cpus",project="test-project",region="europe-west1",source="monitoring"} 20
+gcp_quota_limit{metric="compute.googleapis.com/firewalls",project="test-project",region="europe-west1",source="monitoring"} -1
+gcp_quota_limit{metric="compute.googleapis.com/networks",project="test-project",region="",source="monitoring"} 15
+# HELP gcp_quota_usage quota usage for GCP components
+# TYPE gcp_quota_usage gauge
+gcp_quota_usage{metric="compute.googleapis.com/cpus",project="test-project",region="europe-west1",source="monitoring"} 8
+gcp_quota_usage{metric="compute.googleapis.com/firewalls",project="test-project",region="europe-west1",source="monitoring"} 0
+gcp_quota_usage{metric="compute.googleapis.com/networks",project="test-project",region="",source="monitoring"} 3
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_limit", "gcp_quota_usage"); err != nil {
+		t.Errorf("TestScrapeMonitoring: %v", err)
+	}
+
+	if got := testutil.ToFloat64(exporter.scrapeErrors.WithLabelValues("monitoring", "other")); got != 0 {
+		t.Errorf("TestScrapeMonitoring: scrape errors=%v, expected=0", got)
+	}
+	if got := testutil.CollectAndCount(exporter.scrapeErrors); got != 3*len(scrapeErrorReasons) {
+		t.Errorf("TestScrapeMonitoring: %d scrape error series, expected the monitoring phase initialized", got)
+	}
+
+	for _, filter := range filters {
+		if !strings.Contains(filter, `resource.type = "consumer_quota"`) {
+			t.Errorf("TestScrapeMonitoring: filter=%s, expected consumer_quota resources", filter)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/compute/v1"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var gcpCountNetworkResources = kingpin.Flag(
+	"gcp.count-network-resources", "Count the networks, subnetworks, firewall rules and routes of the project by listing them. Adds four list calls to each scrape.",
+).Default("false").Bool()
+
+// getNetworkResources lists the network resources of the project and emits
+// how many there are of each, named after the project-wide quota they count
+// against, and the number of subnetworks of each network. The counts are up
+// to date even when the usage reported by the quota API lags behind.
+func (e *Exporter) getNetworkResources(ctx context.Context, ch chan<- prometheus.Metric) {
+	if !e.countNetworkResources {
+		return
+	}
+
+	var networks int
+	err := e.service.Networks.List(e.project).Pages(ctx, func(page *compute.NetworkList) error {
+		networks += len(page.Items)
+		return nil
+	})
+	e.emitResourceCount(ch, "NETWORKS", networks, err)
+
+	subnetworks := make(map[string]int)
+	var total int
+	err = e.service.Subnetworks.AggregatedList(e.project).Pages(ctx, func(page *compute.SubnetworkAggregatedList) error {
+		for _, scoped := range page.Items {
+			for _, subnetwork := range scoped.Subnetworks {
+				subnetworks[path.Base(subnetwork.Network)]++
+				total++
+			}
+		}
+		return nil
+	})
+	e.emitResourceCount(ch, "SUBNETWORKS", total, err)
+	if err == nil {
+		for network, count := range subnetworks {
+			ch <- prometheus.MustNewConstMetric(networkSubnetworksDesc, prometheus.GaugeValue, float64(count), e.project, network)
+		}
+	}
+
+	var firewalls int
+	err = e.service.Firewalls.List(e.project).Pages(ctx, func(page *compute.FirewallList) error {
+		firewalls += len(page.Items)
+		return nil
+	})
+	e.emitResourceCount(ch, "FIREWALLS", firewalls, err)
+
+	var routes int
+	err = e.service.Routes.List(e.project).Pages(ctx, func(page *compute.RouteList) error {
+		routes += len(page.Items)
+		return nil
+	})
+	e.emitResourceCount(ch, "ROUTES", routes, err)
+}
+
+// emitResourceCount emits the number of resources counting against
+// quotaMetric, or logs the failure to list them.
+func (e *Exporter) emitResourceCount(ch chan<- prometheus.Metric, quotaMetric string, count int, err error) {
+	if err != nil {
+		level.Error(e.logger).Log("msg", "Failure when counting network resources", "quota_metric", quotaMetric, "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(resourceCountDesc, prometheus.GaugeValue, float64(count), e.project, quotaMetric)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// uncheckedCollector hides the descriptors of a collector from the registry.
+// The Describe of an Exporter scrapes the Google API, which would double the
+// calls made by every probe.
+type uncheckedCollector struct {
+	prometheus.Collector
+}
+
+// Describe implements prometheus.Collector.
+func (uncheckedCollector) Describe(chan<- *prometheus.Desc) {}
+
+// probeHandler serves the quotas of the project given by the project query
+// parameter, following the multi-target exporter pattern. A monitored project
+// is probed with the clients and filters of its exporter, so with its own
+// credentials, others with the clients returned by shared. Every probe collects with a new Exporter,
+// so state kept between scrapes, such as stale markers and removed quotas,
+// isn't available.
+func probeHandler(es exporterSource, shared func() (googleClients, error), logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		project := r.URL.Query().Get("project")
+		if project == "" {
+			http.Error(w, "project parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		// The exporters change on reloads, so they're looked up on each
+		// probe.
+		var clients googleClients
+		var monitored *Exporter
+		for _, e := range es.current() {
+			if e.project == project {
+				monitored = e
+				clients = e.clients()
+				break
+			}
+		}
+		if monitored == nil {
+			var err error
+			if clients, err = shared(); err != nil {
+				level.Error(logger).Log("msg", "Unable to create Google API clients for probe", "project", project, "error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		exporter, err := newClientsExporter(clients, project, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Unable to create exporter for probe", "project", project, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if monitored != nil {
+			exporter.metricFilter, exporter.regionFilter = monitored.metricFilter, monitored.regionFilter
+		}
+		// Probes are never refreshed in the background, so they scrape
+		// the Google API themselves.
+		exporter.scrapeInterval = 0
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(uncheckedCollector{exporter})
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: *webOpenMetrics}).ServeHTTP(w, r)
+	}
+}
+
+// lazyClients returns a function creating the clients with newClients on its
+// first call, so that a missing credential only fails the probes needing it.
+// A failure is retried on the next call.
+func lazyClients(newClients func() (googleClients, error)) func() (googleClients, error) {
+	var mutex sync.Mutex
+	var clients *googleClients
+	return func() (googleClients, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if clients == nil {
+			created, err := newClients()
+			if err != nil {
+				return googleClients{}, err
+			}
+			clients = &created
+		}
+		return *clients, nil
+	}
+}
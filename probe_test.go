@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	promlog "github.com/prometheus/common/promlog"
+)
+
+func TestProbeHandler(t *testing.T) {
+	services := *gcpServices
+	*gcpServices = []string{"pubsub.googleapis.com"}
+	defer func() { *gcpServices = services }()
+
+	// Projects that aren't monitored are probed with the shared clients.
+	shared := newReplayExporter(t, "testdata/fixtures").clients()
+	shared.serviceUsage = newFakeServiceUsage(t, `{"metrics":[{"metric":"pubsub.googleapis.com/topics","consumerQuotaLimits":[
+		{"unit":"1/{project}","quotaBuckets":[{"effectiveLimit":"10000"}]}
+	]}]}`)
+	handler := probeHandler(exporters{}, func() (googleClients, error) { return shared, nil }, promlog.New(&promlog.Config{}))
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/probe", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("TestProbeHandler: status=%d without project, expected=%d", recorder.Code, http.StatusBadRequest)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/probe?project=test-project", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("TestProbeHandler: status=%d, expected=%d", recorder.Code, http.StatusOK)
+	}
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, expected := range []string{
+		`gcp_quota_limit{metric="CPUS",project="test-project",region="europe-west1",service="compute.googleapis.com",source="compute"} 24`,
+		`gcp_quota_limit{metric="pubsub.googleapis.com/topics",project="test-project",region="",service="pubsub.googleapis.com",source="serviceusage"} 10000`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("TestProbeHandler: body doesn't contain %s:\n%s", expected, body)
+		}
+	}
+}
+
+func TestProbeHandlerMonitoredProject(t *testing.T) {
+	// The shared clients can't read anything, the monitored project's can.
+	shared := newReplayExporter(t, t.TempDir()).clients()
+	monitored := newProjectReplayExporter(t, "testdata/fixtures", "monitored-project")
+	var err error
+	if monitored.metricFilter, err = newNameFilter([]string{"CPUS"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	set := &exporterSet{}
+	handler := probeHandler(set, func() (googleClients, error) { return shared, nil }, promlog.New(&promlog.Config{}))
+	probe := func() string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/probe?project=monitored-project", nil))
+		return recorder.Body.String()
+	}
+
+	if body := probe(); !strings.Contains(body, `gcp_quota_project_up{project="monitored-project"} 0`) {
+		t.Errorf("TestProbeHandlerMonitoredProject: expected the shared clients to be used before the project is monitored:\n%s", body)
+	}
+
+	// The project is monitored after a reload.
+	set.mutex.Lock()
+	set.es = exporters{monitored}
+	set.mutex.Unlock()
+	body := probe()
+	if !strings.Contains(body, `gcp_quota_project_up{project="monitored-project"} 1`) {
+		t.Errorf("TestProbeHandlerMonitoredProject: expected the clients of the monitored project to be used:\n%s", body)
+	}
+	// Its filters apply too, only CPUS is left.
+	if strings.Contains(body, `gcp_quota_limit{metric="NETWORKS"`) || !strings.Contains(body, `gcp_quota_limit{metric="CPUS"`) {
+		t.Errorf("TestProbeHandlerMonitoredProject: expected the metric filter of the monitored project to apply:\n%s", body)
+	}
+}
+
+func TestProbeHandlerWithoutSharedClients(t *testing.T) {
+	// Without fallback credentials, only the probes needing them fail.
+	calls := 0
+	shared := lazyClients(func() (googleClients, error) {
+		calls++
+		return googleClients{}, errors.New("google: could not find default credentials")
+	})
+	monitored := newProjectReplayExporter(t, "testdata/fixtures", "monitored-project")
+	handler := probeHandler(exporters{monitored}, shared, promlog.New(&promlog.Config{}))
+
+	for project, expected := range map[string]int{"monitored-project": http.StatusOK, "other-project": http.StatusInternalServerError} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/probe?project="+project, nil))
+		if recorder.Code != expected {
+			t.Errorf("TestProbeHandlerWithoutSharedClients: %s status=%d, expected=%d", project, recorder.Code, expected)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("TestProbeHandlerWithoutSharedClients: shared clients created %d times, expected once", calls)
+	}
+}
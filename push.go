@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pushedMetric reports whether the metric family name is written to the push
+// sinks.
+func pushedMetric(name string) bool {
+	return name == metricPrefix+"_limit" || name == metricPrefix+"_usage"
+}
+
+// runPeriodically calls push immediately and then every interval until the
+// process exits, logging failures.
+func runPeriodically(interval time.Duration, logger log.Logger, push func(now time.Time) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := push(time.Now()); err != nil {
+			level.Error(logger).Log("msg", "Failure when pushing metrics", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+// pushCollector collects the exporters of es for a push sink. The metrics of
+// a collection that ended less than maxAge ago, e.g. for Prometheus, are sent
+// again rather than scraping the Google API, which would double the API calls
+// and hand the stale markers and removed quotas of the next scrape to the
+// sink instead of Prometheus. Like uncheckedCollector it has no descriptors,
+// as describing an Exporter scrapes the Google API.
+type pushCollector struct {
+	es     exporterSource
+	maxAge time.Duration
+}
+
+// Describe implements prometheus.Collector.
+func (pushCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c pushCollector) Collect(ch chan<- prometheus.Metric) {
+	var stale exporters
+	for _, e := range c.es.current() {
+		metrics, ok := e.recentMetrics(c.maxAge)
+		if !ok {
+			stale = append(stale, e)
+			continue
+		}
+		for _, metric := range metrics {
+			ch <- metric
+		}
+	}
+	stale.collect(context.Background(), ch)
+}
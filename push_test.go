@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPushCollector(t *testing.T) {
+	var projectCalls int32
+	handler := replayHandler(t, "testdata/fixtures")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/compute/v1/projects/test-project" {
+			atomic.AddInt32(&projectCalls, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	exporter := newServerExporter(t, server, "test-project")
+	collector := pushCollector{es: exporters{exporter}, maxAge: time.Hour}
+
+	// Without a collection to replay, the push collects.
+	if got := testutil.CollectAndCount(collector, "gcp_quota_limit"); got != 10 {
+		t.Errorf("TestPushCollector: gcp_quota_limit series=%d, expected=10", got)
+	}
+	if calls := atomic.LoadInt32(&projectCalls); calls != 1 {
+		t.Errorf("TestPushCollector: %d Projects.Get calls, expected 1", calls)
+	}
+
+	// A recent collection, here the push's own, is replayed.
+	if got := testutil.CollectAndCount(collector, "gcp_quota_limit"); got != 10 {
+		t.Errorf("TestPushCollector(replayed): gcp_quota_limit series=%d, expected=10", got)
+	}
+	if calls := atomic.LoadInt32(&projectCalls); calls != 1 {
+		t.Errorf("TestPushCollector(replayed): %d Projects.Get calls, expected no new one", calls)
+	}
+
+	// An older one isn't.
+	collector.maxAge = 0
+	testutil.CollectAndCount(collector, "gcp_quota_limit")
+	if calls := atomic.LoadInt32(&projectCalls); calls != 2 {
+		t.Errorf("TestPushCollector(expired): %d Projects.Get calls, expected 2", calls)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// quotaDescriptions maps Compute Engine quota metrics to a short human
+// readable description, exported through the gcp_quota_info metric.
+// Metrics missing from this table are exported without an info metric.
+var quotaDescriptions = map[string]string{
+	"AUTOSCALERS":                          "Autoscalers",
+	"BACKEND_BUCKETS":                      "Backend buckets",
+	"BACKEND_SERVICES":                     "Backend services",
+	"C2_CPUS":                              "C2 vCPUs",
+	"C2D_CPUS":                             "C2D vCPUs",
+	"COMMITMENTS":                          "Committed use discount commitments",
+	"COMMITTED_CPUS":                       "Committed N1 vCPUs",
+	"CPUS":                                 "General purpose vCPUs (N1, E2, F1 and G1 machine types)",
+	"CPUS_ALL_REGIONS":                     "vCPUs across all regions",
+	"DISKS_TOTAL_GB":                       "Total standard persistent disk capacity in GB",
+	"E2_CPUS":                              "E2 vCPUs",
+	"FIREWALLS":                            "VPC firewall rules",
+	"FORWARDING_RULES":                     "Forwarding rules",
+	"GLOBAL_INTERNAL_ADDRESSES":            "Global internal IP addresses",
+	"GPUS_ALL_REGIONS":                     "GPUs across all regions",
+	"HEALTH_CHECKS":                        "Health checks",
+	"IMAGES":                               "Custom images",
+	"IN_USE_ADDRESSES":                     "In-use external IP addresses",
+	"INSTANCE_GROUP_MANAGERS":              "Managed instance groups",
+	"INSTANCE_GROUPS":                      "Instance groups",
+	"INSTANCE_TEMPLATES":                   "Instance templates",
+	"INSTANCES":                            "VM instances",
+	"INTERNAL_ADDRESSES":                   "Regional internal IP addresses",
+	"LOCAL_SSD_TOTAL_GB":                   "Total local SSD capacity in GB",
+	"M1_CPUS":                              "M1 vCPUs",
+	"N2_CPUS":                              "N2 vCPUs",
+	"N2D_CPUS":                             "N2D vCPUs",
+	"NETWORKS":                             "VPC networks",
+	"NVIDIA_A100_GPUS":                     "NVIDIA A100 GPUs",
+	"NVIDIA_K80_GPUS":                      "NVIDIA K80 GPUs",
+	"NVIDIA_P100_GPUS":                     "NVIDIA P100 GPUs",
+	"NVIDIA_P4_GPUS":                       "NVIDIA P4 GPUs",
+	"NVIDIA_T4_GPUS":                       "NVIDIA T4 GPUs",
+	"NVIDIA_V100_GPUS":                     "NVIDIA V100 GPUs",
+	"PREEMPTIBLE_CPUS":                     "Preemptible vCPUs",
+	"PREEMPTIBLE_LOCAL_SSD_GB":             "Preemptible local SSD capacity in GB",
+	"ROUTERS":                              "Cloud Routers",
+	"ROUTES":                               "VPC routes",
+	"SECURITY_POLICIES":                    "Cloud Armor security policies",
+	"SNAPSHOTS":                            "Persistent disk snapshots",
+	"SSD_TOTAL_GB":                         "Total SSD persistent disk capacity in GB",
+	"SSL_CERTIFICATES":                     "SSL certificates",
+	"STATIC_ADDRESSES":                     "Static external IP addresses",
+	"SUBNETWORKS":                          "VPC subnetworks",
+	"TARGET_HTTP_PROXIES":                  "Target HTTP proxies",
+	"TARGET_HTTPS_PROXIES":                 "Target HTTPS proxies",
+	"TARGET_POOLS":                         "Target pools",
+	"URL_MAPS":                             "URL maps",
+	"VPN_GATEWAYS":                         "HA VPN gateways",
+	"VPN_TUNNELS":                          "VPN tunnels",
+	"EXTERNAL_NETWORK_LB_FORWARDING_RULES": "External network load balancer forwarding rules",
+}
+
+// quotaUnits maps Compute Engine quota metrics to the unit of their limit and
+// usage, exported through the gcp_quota_unit_info metric. Most quotas count
+// resources, the _GB ones are capacities. --gcp.quota-unit extends it.
+var quotaUnits = map[string]string{
+	"AUTOSCALERS":                          "count",
+	"BACKEND_BUCKETS":                      "count",
+	"BACKEND_SERVICES":                     "count",
+	"C2_CPUS":                              "count",
+	"C2D_CPUS":                             "count",
+	"COMMITMENTS":                          "count",
+	"COMMITTED_CPUS":                       "count",
+	"CPUS":                                 "count",
+	"CPUS_ALL_REGIONS":                     "count",
+	"DISKS_TOTAL_GB":                       "gigabytes",
+	"E2_CPUS":                              "count",
+	"FIREWALLS":                            "count",
+	"FORWARDING_RULES":                     "count",
+	"GLOBAL_INTERNAL_ADDRESSES":            "count",
+	"GPUS_ALL_REGIONS":                     "count",
+	"HEALTH_CHECKS":                        "count",
+	"IMAGES":                               "count",
+	"IN_USE_ADDRESSES":                     "count",
+	"INSTANCE_GROUP_MANAGERS":              "count",
+	"INSTANCE_GROUPS":                      "count",
+	"INSTANCE_TEMPLATES":                   "count",
+	"INSTANCES":                            "count",
+	"INTERNAL_ADDRESSES":                   "count",
+	"LOCAL_SSD_TOTAL_GB":                   "gigabytes",
+	"M1_CPUS":                              "count",
+	"N2_CPUS":                              "count",
+	"N2D_CPUS":                             "count",
+	"NETWORKS":                             "count",
+	"NVIDIA_A100_GPUS":                     "count",
+	"NVIDIA_K80_GPUS":                      "count",
+	"NVIDIA_P100_GPUS":                     "count",
+	"NVIDIA_P4_GPUS":                       "count",
+	"NVIDIA_T4_GPUS":                       "count",
+	"NVIDIA_V100_GPUS":                     "count",
+	"PREEMPTIBLE_CPUS":                     "count",
+	"PREEMPTIBLE_LOCAL_SSD_GB":             "gigabytes",
+	"ROUTERS":                              "count",
+	"ROUTES":                               "count",
+	"SECURITY_POLICIES":                    "count",
+	"SNAPSHOTS":                            "count",
+	"SSD_TOTAL_GB":                         "gigabytes",
+	"SSL_CERTIFICATES":                     "count",
+	"STATIC_ADDRESSES":                     "count",
+	"SUBNETWORKS":                          "count",
+	"TARGET_HTTP_PROXIES":                  "count",
+	"TARGET_HTTPS_PROXIES":                 "count",
+	"TARGET_POOLS":                         "count",
+	"URL_MAPS":                             "count",
+	"VPN_GATEWAYS":                         "count",
+	"VPN_TUNNELS":                          "count",
+	"EXTERNAL_NETWORK_LB_FORWARDING_RULES": "count",
+}
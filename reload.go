@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exporterSource returns the exporters of the monitored projects. They change
+// when the config file is reloaded, so handlers ask for them on each request.
+type exporterSource interface {
+	current() exporters
+}
+
+func (es exporters) current() exporters {
+	return es
+}
+
+// exporterSet holds the exporters of the monitored projects and replaces them
+// as a whole when the config file is reloaded.
+type exporterSet struct {
+	mutex  sync.RWMutex
+	es     exporters
+	paused bool
+
+	// load builds the exporters of the current config file, nil when the
+	// projects were given on the command line.
+	load func() (exporters, error)
+
+	// done stops the background scrapes of es, nil until
+	// refreshPeriodically starts them.
+	done chan struct{}
+}
+
+func (s *exporterSet) current() exporters {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.es
+}
+
+// reload builds new exporters from the config file and swaps them in. The
+// current exporters are kept when the config file is invalid.
+func (s *exporterSet) reload() error {
+	if s.load == nil {
+		return fmt.Errorf("Error reloading: no --config.file to reload")
+	}
+	es, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.paused {
+		es.Pause()
+	}
+	if s.done != nil {
+		close(s.done)
+		s.done = make(chan struct{})
+		es.refreshPeriodically(s.done)
+	}
+	s.es = es
+	return nil
+}
+
+// refreshPeriodically starts the background scrapes of the current exporters,
+// and of those of later reloads.
+func (s *exporterSet) refreshPeriodically() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.done = make(chan struct{})
+	s.es.refreshPeriodically(s.done)
+}
+
+// refreshPeriodically starts the background scrapes of es, until done is
+// closed.
+func (es exporters) refreshPeriodically(done <-chan struct{}) {
+	for _, e := range es {
+		go e.refreshPeriodically(done)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *exporterSet) Describe(ch chan<- *prometheus.Desc) {
+	s.current().Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *exporterSet) Collect(ch chan<- prometheus.Metric) {
+	s.current().Collect(ch)
+}
+
+// Pause pauses the current exporters and those of later reloads.
+func (s *exporterSet) Pause() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.paused = true
+	s.es.Pause()
+}
+
+func (s *exporterSet) Resume() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.paused = false
+	s.es.Resume()
+}
+
+func (s *exporterSet) ScrapeInProgressSeconds() float64 {
+	return s.current().ScrapeInProgressSeconds()
+}
+
+func (s *exporterSet) Health() string {
+	return s.current().Health()
+}
+
+// reloadHandler reloads the config file on POST requests, answering 400 with
+// the error when it is invalid.
+func reloadHandler(s *exporterSet, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.reload(); err != nil {
+			level.Error(logger).Log("msg", "Failure when reloading the config file", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level.Info(logger).Log("msg", "Config file reloaded")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// reloadOnSIGHUP reloads the config file whenever the process receives a
+// SIGHUP, until it exits.
+func reloadOnSIGHUP(s *exporterSet, logger log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := s.reload(); err != nil {
+				level.Error(logger).Log("msg", "Failure when reloading the config file", "error", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Config file reloaded")
+		}
+	}()
+}
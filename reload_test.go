@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	promlog "github.com/prometheus/common/promlog"
+)
+
+func TestReloadHandler(t *testing.T) {
+	prod := newProjectReplayExporter(t, "testdata/fixtures", "prod")
+	staging := newProjectReplayExporter(t, "testdata/fixtures", "staging")
+	loadErr := errors.New("Error parsing config file")
+	var next exporters
+	set := &exporterSet{es: exporters{prod}, load: func() (exporters, error) {
+		if next == nil {
+			return nil, loadErr
+		}
+		return next, nil
+	}}
+	handler := reloadHandler(set, promlog.New(&promlog.Config{}))
+	reload := func(method string) int {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(method, "/-/reload", nil))
+		return recorder.Code
+	}
+
+	if code := reload(http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("TestReloadHandler: GET status=%d, expected=%d", code, http.StatusMethodNotAllowed)
+	}
+
+	// An invalid config file keeps the current exporters.
+	if code := reload(http.MethodPost); code != http.StatusBadRequest {
+		t.Errorf("TestReloadHandler: status=%d for an invalid config, expected=%d", code, http.StatusBadRequest)
+	}
+	if es := set.current(); len(es) != 1 || es[0] != prod {
+		t.Errorf("TestReloadHandler: exporters replaced by an invalid config")
+	}
+
+	// The new exporters inherit the pause.
+	set.Pause()
+	next = exporters{prod, staging}
+	if code := reload(http.MethodPost); code != http.StatusOK {
+		t.Errorf("TestReloadHandler: status=%d, expected=%d", code, http.StatusOK)
+	}
+	if es := set.current(); len(es) != 2 || es[1] != staging {
+		t.Fatalf("TestReloadHandler: exporters=%v, expected prod and staging", es)
+	}
+	if !staging.paused {
+		t.Error("TestReloadHandler: reloaded exporter isn't paused")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	serviceusage "google.golang.org/api/serviceusage/v1beta1"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// sourceServiceUsage is the source label value of quotas read from the
+// Service Usage API.
+const sourceServiceUsage = "serviceusage"
+
+// computeServiceName is the service label value of quotas read from the
+// Compute Engine API.
+const computeServiceName = "compute.googleapis.com"
+
+var (
+	serviceUpDesc *prometheus.Desc
+
+	gcpServices = kingpin.Flag(
+		"gcp.services", "Service whose consumer quotas are read from the Service Usage API, e.g. pubsub.googleapis.com. Can be repeated. Adds a service label to the quota metrics.",
+	).PlaceHolder("SERVICE").Strings()
+)
+
+// newServiceUsageService returns an authenticated Service Usage API client.
+func newServiceUsageService(logger log.Logger, credentialsFile string) (*serviceusage.APIService, error) {
+	googleClient, err := newGoogleClient(logger, credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := serviceusage.NewService(context.Background(), option.WithHTTPClient(googleClient))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Service Usage service: %v", err)
+	}
+	return service, nil
+}
+
+// serviceQuotaKey identifies the limit of a Service Usage quota metric in a
+// region, or project-wide when region is empty.
+type serviceQuotaKey struct {
+	metric string
+	region string
+}
+
+// serviceQuotas are the limits of the consumer quotas of a service, keyed in
+// the order they were returned. err is set when they couldn't be read.
+type serviceQuotas struct {
+	service string
+	keys    []serviceQuotaKey
+	limits  map[serviceQuotaKey]float64
+	err     error
+}
+
+// getServiceQuotas emits the limits of the consumer quotas of the configured
+// services. The Service Usage API doesn't report usage, so only
+// gcp_quota_limit is emitted.
+func (e *Exporter) getServiceQuotas(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.emitServiceQuotas(ch, e.readServiceQuotas(ctx), time.Time{})
+}
+
+// readServiceQuotas reads the limits of the consumer quotas of the configured
+// services from the Service Usage API.
+func (e *Exporter) readServiceQuotas(ctx context.Context) []serviceQuotas {
+	if e.serviceUsage == nil {
+		return nil
+	}
+
+	var all []serviceQuotas
+	for _, service := range e.services {
+		var keys []serviceQuotaKey
+		limits := make(map[serviceQuotaKey]float64)
+		parent := "projects/" + e.project + "/services/" + service
+		err := e.serviceUsage.Services.ConsumerQuotaMetrics.List(parent).View("BASIC").Pages(ctx, func(page *serviceusage.ListConsumerQuotaMetricsResponse) error {
+			for _, metric := range page.Metrics {
+				for _, limit := range metric.ConsumerQuotaLimits {
+					if isRateLimit(limit.Unit) {
+						continue
+					}
+					for _, bucket := range limit.QuotaBuckets {
+						region, ok := bucketRegion(bucket)
+						if !ok || (region != "" && !e.regionFilter.matches(region)) {
+							continue
+						}
+						key := serviceQuotaKey{metric.Metric, region}
+						value := float64(bucket.EffectiveLimit)
+						previous, seen := limits[key]
+						if !seen {
+							keys = append(keys, key)
+						}
+						// When a quota has several limits, the lowest one
+						// applies. -1 means unlimited.
+						if !seen || previous < 0 || (value >= 0 && value < previous) {
+							limits[key] = value
+						}
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			level.Error(e.logger).Log("msg", "Failure when querying service quotas", "service", service, "error", err)
+		}
+		all = append(all, serviceQuotas{service: service, keys: keys, limits: limits, err: err})
+	}
+	return all
+}
+
+// emitServiceQuotas emits the limits of quotas along with the service up
+// metrics. Limits served from the background cache carry fetched, the time
+// they were read, see emitQuotaSample.
+func (e *Exporter) emitServiceQuotas(ch chan<- prometheus.Metric, quotas []serviceQuotas, fetched time.Time) {
+	for _, service := range quotas {
+		if service.err != nil {
+			ch <- prometheus.MustNewConstMetric(serviceUpDesc, prometheus.GaugeValue, 0, e.project, service.service)
+			continue
+		}
+
+		for _, key := range service.keys {
+			quota := &compute.Quota{Metric: key.metric, Limit: service.limits[key]}
+			if !e.includeLimit(quota) || !e.plausible(key.region, key.metric, "limit", quota.Limit) {
+				continue
+			}
+			e.emitQuotaSample(ch, e.limitDesc, quota.Limit, e.sourceQuotaLabelValues(sourceServiceUsage, service.service, key.region, "", key.metric), fetched)
+			if unlimited(quota) {
+				ch <- prometheus.MustNewConstMetric(unlimitedDesc, prometheus.GaugeValue, 1, e.project, key.region, key.metric)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(serviceUpDesc, prometheus.GaugeValue, 1, e.project, service.service)
+	}
+}
+
+// isRateLimit reports whether unit, e.g. "1/min/{project}", is the unit of a
+// rate quota rather than of an allocation quota such as "1/{project}".
+func isRateLimit(unit string) bool {
+	for _, part := range strings.Split(unit, "/") {
+		switch part {
+		case "s", "min", "h", "d":
+			return true
+		}
+	}
+	return false
+}
+
+// bucketRegion returns the region a quota bucket applies to, empty for
+// project-wide buckets. Buckets scoped by any other dimension, e.g. a zone,
+// are not exported.
+func bucketRegion(bucket *serviceusage.QuotaBucket) (string, bool) {
+	region, ok := bucket.Dimensions["region"]
+	if len(bucket.Dimensions) > 1 || (len(bucket.Dimensions) == 1 && !ok) {
+		return "", false
+	}
+	return region, true
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/option"
+	serviceusage "google.golang.org/api/serviceusage/v1beta1"
+)
+
+// newFakeServiceUsage returns a Service Usage API client of a server
+// answering every request with body.
+func newFakeServiceUsage(t *testing.T, body string) *serviceusage.APIService {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	service, err := serviceusage.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestServiceQuotas(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1beta1/projects/test-project/services/pubsub.googleapis.com/consumerQuotaMetrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"metrics":[
+			{"metric":"pubsub.googleapis.com/topics","consumerQuotaLimits":[
+				{"unit":"1/min/{project}","quotaBuckets":[{"effectiveLimit":"6000"}]},
+				{"unit":"1/{project}","quotaBuckets":[{"effectiveLimit":"10000"}]},
+				{"unit":"1/{project}/{region}","quotaBuckets":[
+					{"effectiveLimit":"500","dimensions":{"region":"us-east1"}},
+					{"effectiveLimit":"-1","dimensions":{"zone":"us-east1-b"}}
+				]}
+			]},
+			{"metric":"pubsub.googleapis.com/snapshots","consumerQuotaLimits":[
+				{"unit":"1/{project}","quotaBuckets":[{"effectiveLimit":"-1"}]},
+				{"unit":"1/{project}","quotaBuckets":[{"effectiveLimit":"200"}]}
+			]}
+		]}`))
+	}))
+	defer server.Close()
+
+	services := *gcpServices
+	*gcpServices = []string{"pubsub.googleapis.com", "unknown.googleapis.com"}
+	defer func() { *gcpServices = services }()
+
+	// The replay server has no fixtures, so the Compute calls get a 404.
+	exporter := newReplayExporter(t, t.TempDir())
+	var err error
+	exporter.serviceUsage, err = serviceusage.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP gcp_quota_limit quota limits for GCP components
+# TYPE gcp_quota_limit gauge
+gcp_quota_limit{metric="pubsub.googleapis.com/snapshots",project="test-project",region="",service="pubsub.googleapis.com",source="serviceusage"} 200
+gcp_quota_limit{metric="pubsub.googleapis.com/topics",project="test-project",region="",service="pubsub.googleapis.com",source="serviceusage"} 10000
+gcp_quota_limit{metric="pubsub.googleapis.com/topics",project="test-project",region="us-east1",service="pubsub.googleapis.com",source="serviceusage"} 500
+# HELP gcp_quota_service_up Was the last scrape of the Service Usage API for the service successful.
+# TYPE gcp_quota_service_up gauge
+gcp_quota_service_up{project="test-project",service="pubsub.googleapis.com"} 1
+gcp_quota_service_up{project="test-project",service="unknown.googleapis.com"} 0
+`
+	if err := testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gcp_quota_limit", "gcp_quota_service_up"); err != nil {
+		t.Errorf("TestServiceQuotas: %v", err)
+	}
+}
+
+func TestServiceQuotaStaleMarkers(t *testing.T) {
+	// The topics quota is only returned while topics is set.
+	var topics int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.LoadInt32(&topics) == 0 {
+			w.Write([]byte(`{"metrics":[]}`))
+			return
+		}
+		w.Write([]byte(`{"metrics":[
+			{"metric":"pubsub.googleapis.com/topics","consumerQuotaLimits":[
+				{"unit":"1/{project}","quotaBuckets":[{"effectiveLimit":"10000"}]}
+			]}
+		]}`))
+	}))
+	defer server.Close()
+
+	services := *gcpServices
+	*gcpServices = []string{"pubsub.googleapis.com"}
+	defer func() { *gcpServices = services }()
+
+	exporter := newReplayExporter(t, t.TempDir())
+	exporter.staleMarkers = true
+	var err error
+	exporter.serviceUsage, err = serviceusage.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(exporter)
+
+	// gather returns the value of the topics limit, failing on duplicates.
+	gather := func() (float64, bool) {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("TestServiceQuotaStaleMarkers: gather failed: %v", err)
+		}
+		for _, family := range families {
+			if family.GetName() != "gcp_quota_limit" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				return m.GetGauge().GetValue(), true
+			}
+		}
+		return 0, false
+	}
+
+	if value, ok := gather(); !ok || value != 10000 {
+		t.Errorf("TestServiceQuotaStaleMarkers: limit=%v, expected=10000", value)
+	}
+	atomic.StoreInt32(&topics, 0)
+	if value, ok := gather(); !ok || math.Float64bits(value) != staleNaN {
+		t.Errorf("TestServiceQuotaStaleMarkers: limit=%v after the quota was removed, expected a stale marker", value)
+	}
+	// A quota coming back gets a sample, not also a stale marker.
+	atomic.StoreInt32(&topics, 1)
+	if value, ok := gather(); !ok || value != 10000 {
+		t.Errorf("TestServiceQuotaStaleMarkers: limit=%v after the quota came back, expected=10000", value)
+	}
+}
+
+func TestCachedServiceQuotas(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"metrics":[
+			{"metric":"pubsub.googleapis.com/topics","consumerQuotaLimits":[
+				{"unit":"1/{project}","quotaBuckets":[{"effectiveLimit":"10000"}]}
+			]}
+		]}`))
+	}))
+	defer server.Close()
+
+	services := *gcpServices
+	*gcpServices = []string{"pubsub.googleapis.com"}
+	defer func() { *gcpServices = services }()
+
+	exporter := newReplayExporter(t, t.TempDir())
+	exporter.scrapeInterval = time.Minute
+	exporter.cacheTTL = 3 * time.Minute
+	var err error
+	exporter.serviceUsage, err = serviceusage.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter.refresh()
+	// Collections serve the quotas read by the refresh.
+	for i := 0; i < 2; i++ {
+		if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != 1 {
+			t.Errorf("TestCachedServiceQuotas: gcp_quota_limit series=%d, expected=1", got)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("TestCachedServiceQuotas: %d Service Usage API requests, expected only the one of the refresh", got)
+	}
+
+	// They expire with the cache TTL.
+	exporter.lastResourcesTime = time.Now().Add(-4 * time.Minute)
+	if got := testutil.CollectAndCount(exporter, "gcp_quota_limit"); got != 0 {
+		t.Errorf("TestCachedServiceQuotas: gcp_quota_limit series=%d after the cache TTL, expected=0", got)
+	}
+}
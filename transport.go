@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/rehttp"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// apiLastStatus, apiRequests and apiRequestDuration are built by
+// setAPIMetricsPrefix.
+var (
+	apiLastStatus      *prometheus.GaugeVec
+	apiRequests        *prometheus.CounterVec
+	apiRequestDuration *prometheus.HistogramVec
+)
+
+// setAPIMetricsPrefix rebuilds the API metrics with names starting with prefix.
+func setAPIMetricsPrefix(prefix string) {
+	apiLastStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_last_api_status",
+		Help: "HTTP status code of the most recent call to each Google API method, 0 if no response was received.",
+	}, []string{"method"})
+
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_api_requests_total",
+		Help: "Number of HTTP requests sent to each Google API method, retries included, by status code. The code is 0 if no response was received.",
+	}, []string{"method", "code"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prefix + "_api_request_duration_seconds",
+		Help:    "Latency of the HTTP requests sent to each Google API method.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"method"})
+}
+
+// statusTransport records every request and the status of its response in
+// apiLastStatus, apiRequests and apiRequestDuration.
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+
+	method := apiMethod(req)
+	apiLastStatus.WithLabelValues(method).Set(float64(status))
+	apiRequests.WithLabelValues(method, strconv.Itoa(status)).Inc()
+	apiRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// apiMethod names the Compute API method of a request after the resource
+// path below the project, e.g. "projects.get", "regions.list" or
+// "instances.aggregatedList". The global and aggregated segments aren't
+// resources, the method is named after the one following them.
+func apiMethod(req *http.Request) string {
+	segments := resourcePath(req)
+	var aggregated bool
+	if len(segments) > 1 && (segments[0] == "global" || segments[0] == "aggregated") {
+		aggregated = segments[0] == "aggregated"
+		segments = segments[1:]
+	}
+	switch {
+	case len(segments) == 0:
+		return "projects.get"
+	case aggregated:
+		return segments[len(segments)-1] + ".aggregatedList"
+	case len(segments)%2 == 1:
+		return segments[len(segments)-1] + ".list"
+	default:
+		return segments[len(segments)-2] + ".get"
+	}
+}
+
+// resourcePath returns the segments of the request path below the project,
+// e.g. ["regions"] for Regions.List and nothing for Projects.Get.
+func resourcePath(req *http.Request) []string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, segment := range segments {
+		if segment == "projects" && i+1 < len(segments) {
+			return segments[i+2:]
+		}
+	}
+	return segments
+}
+
+// baseTransport returns the transport the Google API calls are sent with,
+// http.DefaultTransport sending through proxyURL when it isn't empty.
+func baseTransport(proxyURL string) (http.RoundTripper, error) {
+	if proxyURL == "" {
+		return http.DefaultTransport, nil
+	}
+
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing --gcp.proxy-url: %v", err)
+	}
+	switch {
+	case proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5":
+		return nil, fmt.Errorf("Error in --gcp.proxy-url: unsupported scheme %q, expected http, https or socks5", proxy.Scheme)
+	case proxy.Host == "":
+		return nil, fmt.Errorf("Error in --gcp.proxy-url: missing host")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+	return transport, nil
+}
+
+// retryConfig holds the retry and backoff settings of a retrying transport.
+type retryConfig struct {
+	maxRetries int
+	statuses   []int
+	jitterBase time.Duration
+	maxBackoff time.Duration
+
+	// maxRetryAfter caps the Retry-After delay of 429 and 503 responses, 0
+	// ignores the header.
+	maxRetryAfter time.Duration
+
+	// temporaryErrors also retries temporary network errors, not only the
+	// configured statuses.
+	temporaryErrors bool
+}
+
+// scrapeRetryConfig returns the retry settings of the quota API calls.
+func scrapeRetryConfig() retryConfig {
+	return retryConfig{
+		maxRetries: *gcpMaxRetries,
+		statuses:   *gcpRetryStatuses, // Cloud support suggests retrying on 503 errors
+		jitterBase: *gcpBackoffJitterBase,
+		maxBackoff: *gcpMaxBackoffDuration, // Set timeout to <10s as that is prom default timeout
+
+		maxRetryAfter: *gcpMaxRetryAfter,
+	}
+}
+
+// bootstrapRetryConfig returns the retry settings of the calls made at
+// startup. They share the backoff settings of the scrape but have their own
+// retry count, and also retry network errors as a failure there is fatal.
+func bootstrapRetryConfig() retryConfig {
+	config := scrapeRetryConfig()
+	config.maxRetries = *gcpBootstrapMaxRetries
+	config.temporaryErrors = true
+	return config
+}
+
+// transport wraps base in a transport retrying with exponential backoff.
+func (c retryConfig) transport(base http.RoundTripper) http.RoundTripper {
+	retryOn := rehttp.RetryStatuses(c.statuses...)
+	if c.temporaryErrors {
+		retryOn = rehttp.RetryAny(retryOn, rehttp.RetryTemporaryErr())
+	}
+	delay := rehttp.ExpJitterDelay(c.jitterBase, c.maxBackoff)
+	if c.maxRetryAfter > 0 {
+		// The Compute API asks to slow down with a 429 and a Retry-After.
+		retryOn = rehttp.RetryAny(retryOn, func(attempt rehttp.Attempt) bool {
+			return attempt.Response != nil && attempt.Response.StatusCode == http.StatusTooManyRequests && attempt.Response.Header.Get("Retry-After") != ""
+		})
+		delay = c.retryAfterDelay(delay)
+	}
+
+	return rehttp.NewTransport(
+		base,
+		rehttp.RetryAll(rehttp.RetryMaxRetries(c.maxRetries), retryOn),
+		delay,
+	)
+}
+
+// retryAfterDelay waits for the Retry-After of 429 and 503 responses, at most
+// maxRetryAfter, and for fallback after other attempts.
+func (c retryConfig) retryAfterDelay(fallback rehttp.DelayFn) rehttp.DelayFn {
+	return func(attempt rehttp.Attempt) time.Duration {
+		resp := attempt.Response
+		if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+			return fallback(attempt)
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return fallback(attempt)
+		}
+		if wait > c.maxRetryAfter {
+			wait = c.maxRetryAfter
+		}
+		return wait
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or
+// an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// retry calls call until it succeeds, retrying it at most maxRetries times
+// with the transport's backoff. Errors carrying an HTTP status were already
+// retried by the transport and are returned as is, retries are for the other
+// failures such as timeouts or malformed bodies.
+func (c retryConfig) retry(ctx context.Context, logger log.Logger, method string, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		var apiErr *googleapi.Error
+		if err == nil || attempt > c.maxRetries || errors.As(err, &apiErr) || ctx.Err() != nil {
+			return err
+		}
+
+		level.Warn(logger).Log("msg", "Google API call failed, retrying", "method", method, "attempt", attempt, "error", err)
+		select {
+		case <-time.After(c.delay(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// delay returns the jittered exponential backoff before the retry following
+// attempt, like rehttp.ExpJitterDelay.
+func (c retryConfig) delay(attempt int) time.Duration {
+	backoff := c.jitterBase << uint(attempt-1)
+	if backoff <= 0 || backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// authRetryTransport authenticates requests to the Google API. When a request
+// is rejected with a 401, the token source is recreated to force a fresh
+// token and the request is retried once. A second 401 means the credentials
+// themselves are no longer valid.
+type authRetryTransport struct {
+	base      http.RoundTripper
+	newSource func() (oauth2.TokenSource, error)
+	logger    log.Logger
+
+	mutex  sync.Mutex
+	source oauth2.TokenSource
+}
+
+func newAuthRetryTransport(base http.RoundTripper, newSource func() (oauth2.TokenSource, error), logger log.Logger) (*authRetryTransport, error) {
+	source, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+
+	return &authRetryTransport{
+		base:      base,
+		newSource: newSource,
+		logger:    logger,
+		source:    source,
+	}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *authRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.authorizedRoundTrip(req, t.tokenSource())
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Only requests whose body can be replayed are retried.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	level.Warn(t.logger).Log("msg", "Google API rejected the access token, retrying with a fresh token", "url", req.URL.Redacted())
+	source, err := t.refresh()
+	if err != nil {
+		level.Error(t.logger).Log("msg", "Unable to refresh Google credentials", "reason", "auth", "error", err)
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err = t.authorizedRoundTrip(retry, source)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		level.Error(t.logger).Log("msg", "Google API rejected freshly refreshed credentials", "reason", "auth", "url", req.URL.Redacted())
+	}
+	return resp, err
+}
+
+func (t *authRetryTransport) tokenSource() oauth2.TokenSource {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.source
+}
+
+// refresh replaces the token source, dropping any cached token.
+func (t *authRetryTransport) refresh() (oauth2.TokenSource, error) {
+	source, err := t.newSource()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.source = source
+	return source, nil
+}
+
+func (t *authRetryTransport) authorizedRoundTrip(req *http.Request, source oauth2.TokenSource) (*http.Response, error) {
+	token, err := source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the request they are given.
+	authorized := req.Clone(req.Context())
+	token.SetAuthHeader(authorized)
+	return t.base.RoundTrip(authorized)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promlog "github.com/prometheus/common/promlog"
+	"golang.org/x/oauth2"
+)
+
+func TestAuthRetryTransport(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("Authorization"))
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sources := 0
+	transport, err := newAuthRetryTransport(http.DefaultTransport, func() (oauth2.TokenSource, error) {
+		sources++
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: fmt.Sprintf("token-%d", sources)}), nil
+	}, promlog.New(&promlog.Config{}))
+	if err != nil {
+		t.Fatalf("TestAuthRetryTransport: %v", err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("TestAuthRetryTransport: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("TestAuthRetryTransport: status=%d, expected=%d", resp.StatusCode, http.StatusOK)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("TestAuthRetryTransport: requests=%d, expected=2", len(requests))
+	}
+	if requests[0] != "Bearer token-1" || requests[1] != "Bearer token-2" {
+		t.Errorf("TestAuthRetryTransport: authorization=%q, expected a fresh token on retry", requests)
+	}
+
+	// A persistent 401 is only retried once.
+	requests = nil
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	resp, err = (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("TestAuthRetryTransport: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized || len(requests) != 2 {
+		t.Errorf("TestAuthRetryTransport: status=%d requests=%d, expected=401 and 2", resp.StatusCode, len(requests))
+	}
+}
+
+func TestBaseTransport(t *testing.T) {
+	transport, err := baseTransport("")
+	if err != nil || transport != http.DefaultTransport {
+		t.Errorf("TestBaseTransport: transport=%v err=%v without proxy, expected http.DefaultTransport", transport, err)
+	}
+
+	transport, err = baseTransport("http://proxy.example.com:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := transport.(*http.Transport).Proxy(httptest.NewRequest(http.MethodGet, "https://compute.googleapis.com/", nil))
+	if err != nil || proxy.String() != "http://proxy.example.com:3128" {
+		t.Errorf("TestBaseTransport: proxy=%v err=%v, expected=http://proxy.example.com:3128", proxy, err)
+	}
+
+	for _, proxyURL := range []string{"proxy.example.com:3128", "ftp://proxy.example.com", "http://", "http://%zz"} {
+		if _, err := baseTransport(proxyURL); err == nil {
+			t.Errorf("TestBaseTransport: proxy=%s, expected an error", proxyURL)
+		}
+	}
+}
+
+func TestStatusTransport(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer server.Close()
+
+	unavailable := testutil.ToFloat64(apiRequests.WithLabelValues("regions.list", "503"))
+	ok := testutil.ToFloat64(apiRequests.WithLabelValues("regions.list", "200"))
+	client := &http.Client{Transport: &statusTransport{base: http.DefaultTransport}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/compute/v1/projects/test-project/regions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(apiRequests.WithLabelValues("regions.list", "503")) - unavailable; got != 1 {
+		t.Errorf("TestStatusTransport: 503 requests=%v, expected=1", got)
+	}
+	if got := testutil.ToFloat64(apiRequests.WithLabelValues("regions.list", "200")) - ok; got != 1 {
+		t.Errorf("TestStatusTransport: 200 requests=%v, expected=1", got)
+	}
+	if got := testutil.ToFloat64(apiLastStatus.WithLabelValues("regions.list")); got != 200 {
+		t.Errorf("TestStatusTransport: last status=%v, expected=200", got)
+	}
+	if got := testutil.CollectAndCount(apiRequestDuration, "gcp_quota_api_request_duration_seconds"); got < 1 {
+		t.Errorf("TestStatusTransport: no gcp_quota_api_request_duration_seconds series")
+	}
+}
+
+func TestAPIMethod(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/compute/v1/projects/test-project":                                    "projects.get",
+		"/compute/v1/projects/test-project/regions":                            "regions.list",
+		"/compute/v1/projects/test-project/regions/us-east1":                   "regions.get",
+		"/compute/v1/projects/test-project/regions/us-east1/subnetworks":       "subnetworks.list",
+		"/compute/v1/projects/test-project/zones/us-east1-b/instances":         "instances.list",
+		"/compute/v1/projects/test-project/global/networks":                    "networks.list",
+		"/compute/v1/projects/test-project/global/firewalls":                   "firewalls.list",
+		"/compute/v1/projects/test-project/global/networks/default":            "networks.get",
+		"/compute/v1/projects/test-project/aggregated/instances":               "instances.aggregatedList",
+		"/compute/v1/projects/test-project/aggregated/disks":                   "disks.aggregatedList",
+		"/compute/v1/projects/test-project/aggregated/subnetworks?pageToken=a": "subnetworks.aggregatedList",
+	} {
+		u, err := url.Parse("https://compute.googleapis.com" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := apiMethod(&http.Request{URL: u}); got != expected {
+			t.Errorf("TestAPIMethod: %s=%q, expected=%q", path, got, expected)
+		}
+	}
+}
+
+func TestLastAPIStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	url := server.URL + "/compute/v1/projects/test-project/zones"
+	client := &http.Client{Transport: &statusTransport{base: http.DefaultTransport}}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := testutil.ToFloat64(apiLastStatus.WithLabelValues("zones.list")); got != 403 {
+		t.Errorf("TestLastAPIStatus: last status=%v, expected=403", got)
+	}
+
+	// A request without response sets it to 0.
+	server.Close()
+	noResponse := testutil.ToFloat64(apiRequests.WithLabelValues("zones.list", "0"))
+	if _, err := client.Get(url); err == nil {
+		t.Fatal("TestLastAPIStatus: expected an error from a closed server")
+	}
+	if got := testutil.ToFloat64(apiLastStatus.WithLabelValues("zones.list")); got != 0 {
+		t.Errorf("TestLastAPIStatus: last status=%v without response, expected=0", got)
+	}
+	if got := testutil.ToFloat64(apiRequests.WithLabelValues("zones.list", "0")) - noResponse; got != 1 {
+		t.Errorf("TestLastAPIStatus: requests without response=%v, expected=1", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// The jittered backoff alone would wait up to an hour.
+	config := retryConfig{maxRetries: 1, statuses: []int{503}, jitterBase: time.Hour, maxBackoff: time.Hour, maxRetryAfter: 50 * time.Millisecond}
+	client := &http.Client{Transport: config.transport(http.DefaultTransport)}
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("TestRetryAfter: status=%d after %v, expected a retry after the capped 50ms", resp.StatusCode, elapsed)
+	}
+
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for header, expected := range map[string]time.Duration{
+		"3":                             3 * time.Second,
+		"Wed, 01 Jun 2022 12:00:10 GMT": 10 * time.Second,
+		"Wed, 01 Jun 2022 11:00:00 GMT": 0,
+	} {
+		if wait, ok := parseRetryAfter(header, now); !ok || wait != expected {
+			t.Errorf("TestRetryAfter: Retry-After %q wait=%v ok=%v, expected=%v", header, wait, ok, expected)
+		}
+	}
+	for _, header := range []string{"", "-1", "soon"} {
+		if _, ok := parseRetryAfter(header, now); ok {
+			t.Errorf("TestRetryAfter: Retry-After %q accepted", header)
+		}
+	}
+}
+
+// temporaryError is a network error worth retrying, like a connection reset.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "connection reset by peer" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+func TestBootstrapRetries(t *testing.T) {
+	defer func(retries, bootstrapRetries int, jitter, backoff time.Duration) {
+		*gcpMaxRetries, *gcpBootstrapMaxRetries, *gcpBackoffJitterBase, *gcpMaxBackoffDuration = retries, bootstrapRetries, jitter, backoff
+	}(*gcpMaxRetries, *gcpBootstrapMaxRetries, *gcpBackoffJitterBase, *gcpMaxBackoffDuration)
+	*gcpMaxRetries, *gcpBootstrapMaxRetries = 5, 2
+	*gcpBackoffJitterBase, *gcpMaxBackoffDuration = time.Millisecond, time.Millisecond
+
+	// failing returns a transport failing the first failures requests with a
+	// temporary network error, and the number of requests it got.
+	failing := func(failures int) (http.RoundTripper, *int) {
+		requests := 0
+		return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			if requests <= failures {
+				return nil, temporaryError{}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		}), &requests
+	}
+
+	for _, test := range []struct {
+		name     string
+		config   retryConfig
+		failures int
+		requests int
+		ok       bool
+	}{
+		{"bootstrap", bootstrapRetryConfig(), 2, 3, true},
+		{"bootstrap exhausted", bootstrapRetryConfig(), 3, 3, false},
+		// The scrape calls only retry the configured statuses.
+		{"scrape", scrapeRetryConfig(), 1, 1, false},
+	} {
+		base, requests := failing(test.failures)
+		resp, err := (&http.Client{Transport: test.config.transport(base)}).Get("http://metadata.google.internal/computeMetadata/v1/project/project-id")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != test.ok || *requests != test.requests {
+			t.Errorf("TestBootstrapRetries(%s): err=%v requests=%d, expected ok=%v and %d requests", test.name, err, *requests, test.ok, test.requests)
+		}
+	}
+}